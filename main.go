@@ -1,11 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"mycache"
+	"mycache/discovery"
+	"mycache/membership"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var db = map[string]string{
@@ -24,55 +33,166 @@ func createGroup() *mycache.Group {
 			if v, ok := db[key]; ok {
 				return []byte(v), nil
 			}
-			return nil, fmt.Errorf("%s not exist", key)
+			return nil, fmt.Errorf("%s: %w", key, mycache.ErrNotFound)
 		}))
 }
 
 // addr是server端地址
-func startCacheServer(addr string, addrs []string, gee *mycache.Group) {
-	// 使用addr初始化server
-	peers := mycache.NewHTTPPool(addr)
-	// 将addrs作为远程节点
-	peers.SetPeers(addrs...)
+func startCacheServer(addr string, peers *mycache.HTTPPool, gee *mycache.Group) {
 	// peers是httppool类型，里面实现了PickPeer功能
 	gee.RegisterPeers(peers)
 
 	log.Println("Mycache is running at", addr)
 
-	// ListenAndServe listens on the TCP network address addr and
-	// then calls [Serve] with handler to handle requests on incoming connections
+	// addr可以是 http(s)://host:port 也可以是 unix:///path
+	l, err := mycache.Listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// unix socket上的peer不使用TLS 见 mycache.TLSOptions
+	if config := peers.TLSConfig(); config != nil && !strings.HasPrefix(addr, "unix://") {
+		l = tls.NewListener(l, config)
+	}
+	log.Fatal(http.Serve(l, peers))
+}
 
-	// [7:] means that localhost:8003
-	log.Fatal(http.ListenAndServe(addr[7:], peers))
+// 节点之间使用TCP通信 只支持固定的节点列表
+func startTCPServer(addr string, addrs []string, hash string, gee *mycache.Group) {
+	// 去掉http:// 只保留host:port
+	var hosts []string
+	for _, a := range addrs {
+		hosts = append(hosts, strings.TrimPrefix(a, "http://"))
+	}
+	self := strings.TrimPrefix(addr, "http://")
+	peers, err := mycache.NewTCPPool(self, &mycache.TCPPoolOptions{HashAlgorithm: hash})
+	if err != nil {
+		log.Fatal(err)
+	}
+	peers.SetPeers(hosts...)
+	gee.RegisterPeers(peers)
+
+	log.Println("Mycache is running at", self, "over tcp")
+	log.Fatal(peers.ListenAndServe(self))
+}
+
+// 节点之间使用h2c上的GroupCache RPC 只支持固定的节点列表
+func startRPCServer(addr string, addrs []string, hash string, gee *mycache.Group) {
+	peers, err := mycache.NewRPCPool(addr, &mycache.RPCPoolOptions{HashAlgorithm: hash})
+	if err != nil {
+		log.Fatal(err)
+	}
+	peers.SetPeers(addrs...)
+	gee.RegisterPeers(peers)
+
+	log.Println("Mycache is running at", addr, "over h2c")
+	log.Fatal(peers.ListenAndServe(strings.TrimPrefix(addr, "http://")))
+}
+
+// 通过gossip发现其他节点 视图变化时自动调用peers.SetPeers
+func startGossip(addr, bindAddr, seeds string, peers *mycache.HTTPPool) *membership.Memberlist {
+	m, err := membership.Create(&membership.Config{
+		Name:     addr,
+		BindAddr: bindAddr,
+		Peers:    peers,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Gossip is running at", m.Addr())
+
+	if seeds != "" {
+		if _, err := m.Join(strings.Split(seeds, ","), 3*time.Second); err != nil {
+			log.Println("[Gossip] Failed to join:", err)
+		}
+	}
+	return m
 }
 
 func startAPIServer(apiAddr string, g *mycache.Group) {
 	http.Handle("/api", http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			key := r.URL.Query().Get("key")
-			view, err := g.Get(key)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			// owner是远程节点时边读边写 出错时如果还没有写出数据仍然可以返回错误
+			if n, err := g.GetStream(key, w); err != nil && n == 0 {
+				code := http.StatusInternalServerError
+				switch {
+				case errors.Is(err, mycache.ErrNotFound):
+					code = http.StatusNotFound
+				case errors.Is(err, mycache.ErrUnavailable):
+					code = http.StatusServiceUnavailable
+				}
+				http.Error(w, err.Error(), code)
 				return
 			}
-			w.Header().Set("Content-Type", "application/octet-stream")
-			w.Write(view.ByteSlice())
 
 		}))
 	log.Println("fontend server is running at", apiAddr)
-	log.Fatal(http.ListenAndServe(apiAddr[7:], nil))
+	l, err := mycache.Listen(apiAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(http.Serve(l, nil))
 
 }
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 && os.Args[1] == "ring" {
+		if err := ringCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var port int
 	var api bool
+	var hash string
+	var gossip, seeds string
+	var peersFile string
+	var dnsName string
+	var dnsSRV bool
+	var warm bool
+	var warmRate int64
+	var transition time.Duration
+	var health time.Duration
+	var hedge float64
+	var onPeerFailure string
+	var peerTimeout time.Duration
+	var transport string
+	var selfAddr, apiAddr, staticPeers string
+	var cacheCompress int
+	var tlsCert, tlsKey, tlsCA string
+	var mtls bool
+	var secret string
 
 	flag.IntVar(&port, "port", 8001, "Mycache Server Port")
 	flag.BoolVar(&api, "api", false, "Start a api server?")
+	flag.StringVar(&hash, "hash", "crc32", "Consistent hash algorithm: crc32, fnv1a64 or crc64")
+	flag.StringVar(&gossip, "gossip", "", "UDP address for gossip membership, e.g. 127.0.0.1:7001; peers are static when empty")
+	flag.StringVar(&seeds, "seeds", "", "Gossip addresses of seed nodes, comma separated")
+	flag.StringVar(&peersFile, "peers-file", "", "JSON file with the peer list, reloaded on change or SIGHUP")
+	flag.StringVar(&dnsName, "dns", "", "Hostname whose records list the peers, refreshed periodically")
+	flag.BoolVar(&dnsSRV, "dns-srv", false, "Resolve SRV records of -dns instead of A records on -port")
+	flag.BoolVar(&warm, "warm", false, "Pull owned entries from the previous owners when joining")
+	flag.Int64Var(&warmRate, "warm-rate", 0, "Max bytes per second pulled while warming up, 0 for unlimited")
+	flag.DurationVar(&transition, "transition", 30*time.Second, "How long the previous ring is consulted on misses after the peers change")
+	flag.DurationVar(&health, "health", 2*time.Second, "Interval of active peer health checks, 0 to disable")
+	flag.Float64Var(&hedge, "hedge", 0.05, "Max fraction of peer requests that may be hedged, 0 to disable")
+	flag.StringVar(&onPeerFailure, "on-peer-failure", "cache", "What to do when the owner fails: cache, nocache, next or fail")
+	flag.DurationVar(&peerTimeout, "peer-timeout", 5*time.Second, "Timeout of a single request to a peer")
+	flag.StringVar(&transport, "transport", "http", "Peer transport: http, tcp or rpc (tcp and rpc only support the static peer list)")
+	flag.StringVar(&selfAddr, "addr", "", "Address of this node, http://host:port or unix:///path; derived from the -dns records or -port when empty")
+	flag.StringVar(&apiAddr, "api-addr", "http://localhost:9999", "Address of the api server, http://host:port or unix:///path")
+	flag.StringVar(&staticPeers, "peers", "", "Static peer addresses, comma separated, http://host:port or unix:///path")
+	flag.IntVar(&cacheCompress, "cache-compress", 0, "Store values of at least this many bytes compressed in the cache, 0 to disable")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file for TLS between peers, reloaded on change; peer addresses must use https://")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file of -tls-cert")
+	flag.StringVar(&tlsCA, "tls-ca", "", "CA file used to verify peer certificates, system CAs when empty")
+	flag.BoolVar(&mtls, "mtls", false, "Require peers to present a certificate signed by -tls-ca")
+	flag.StringVar(&secret, "secret", os.Getenv("MYCACHE_SECRET"), "Shared secret for HMAC signed peer requests, defaults to $MYCACHE_SECRET")
 	flag.Parse()
 
-	apiAddr := "http://localhost:9999"
 	addrMap := map[int]string{
 		8001: "http://localhost:8001",
 		8002: "http://localhost:8002",
@@ -84,10 +204,109 @@ func main() {
 		addrs = append(addrs, v)
 	}
 
+	if staticPeers != "" {
+		addrs = strings.Split(staticPeers, ",")
+	}
+
+	addr, ok := addrMap[port]
+	if !ok {
+		addr = fmt.Sprintf("http://localhost:%d", port)
+	}
+	if selfAddr != "" {
+		addr = selfAddr
+	} else if dnsName != "" {
+		// 其他节点从DNS记录中得到的是pod的地址 自己也必须使用同样的地址
+		self, err := discovery.SelfAddr(discovery.DNSConfig{Name: dnsName, SRV: dnsSRV, Port: port})
+		if err != nil {
+			log.Fatalf("%v; set -addr to the address other peers resolve for this node", err)
+		}
+		addr = self
+	}
+	// 预热拉取的条目要写入已经创建好的group
 	gee := createGroup()
+	policies := map[string]mycache.FailurePolicy{
+		"cache":   mycache.LoadAndCache,
+		"nocache": mycache.LoadNoCache,
+		"next":    mycache.TryNext,
+		"fail":    mycache.FailFast,
+	}
+	policy, ok := policies[onPeerFailure]
+	if !ok {
+		log.Fatalf("unknown peer failure policy %q", onPeerFailure)
+	}
+	gee.SetFailurePolicy(policy)
+	gee.SetCompression(cacheCompress)
+
+	switch transport {
+	case "http":
+	case "tcp", "rpc":
+		if api {
+			go startAPIServer(apiAddr, gee)
+		}
+		if transport == "tcp" {
+			startTCPServer(addr, addrs, hash, gee)
+		} else {
+			startRPCServer(addr, addrs, hash, gee)
+		}
+		return
+	default:
+		log.Fatalf("unknown transport %q", transport)
+	}
+
+	// 使用addr初始化server
+	var members *membership.Memberlist
+	var tlsOpts *mycache.TLSOptions
+	if tlsCert != "" {
+		tlsOpts = &mycache.TLSOptions{CertFile: tlsCert, KeyFile: tlsKey, CAFile: tlsCA, RequireClientCert: mtls}
+	}
+	peers, err := mycache.NewHTTPPoolOpts(addr, &mycache.HTTPPoolOptions{
+		HashAlgorithm: hash,
+		LeaveCluster: func() error {
+			if members == nil {
+				return nil
+			}
+			return members.Leave(time.Second)
+		},
+		OnDrained:           func() { os.Exit(0) },
+		WarmJoin:            warm,
+		WarmupRate:          warmRate,
+		TransitionWindow:    transition,
+		HealthCheckInterval: health,
+		HedgeBudget:         hedge,
+		RequestTimeout:      peerTimeout,
+		TLS:                 tlsOpts,
+		SharedSecret:        []byte(secret),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case gossip != "":
+		members = startGossip(addr, gossip, seeds, peers)
+	case peersFile != "":
+		if _, err := discovery.WatchFile(peersFile, peers, 0); err != nil {
+			log.Fatal(err)
+		}
+	case dnsName != "":
+		if _, err := discovery.WatchDNS(discovery.DNSConfig{Name: dnsName, SRV: dnsSRV, Port: port}, peers); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		// 将addrs作为远程节点
+		peers.SetPeers(addrs...)
+	}
+
+	// 收到退出信号时先把缓存迁移给其他节点
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		peers.Drain()
+	}()
+
 	if api {
 		go startAPIServer(apiAddr, gee)
 	}
-	startCacheServer(addrMap[port], []string(addrs), gee)
+	startCacheServer(addr, peers, gee)
 
 }
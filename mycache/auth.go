@@ -0,0 +1,222 @@
+package mycache
+
+// 节点间的认证
+// 默认任何能访问到端口的人都可以读取任意group 两种方式可以限制只有集群中的节点才能访问
+// 1. TLS/mTLS 节点之间使用https 服务端可以要求客户端出示CA签发的证书 证书文件变化之后自动重新加载
+// 2. 共享密钥 没有PKI的环境中 请求带上用共享密钥计算的HMAC签名 签名覆盖方法、路径、时间戳和请求体
+// 两种方式可以同时使用 未通过认证的请求返回401 计入 Stats.AuthRejected
+// /healthz 不需要认证
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	timestampHeader = "X-Mycache-Timestamp"
+	signatureHeader = "X-Mycache-Signature"
+
+	// 签名中的时间戳与本地时间相差超过这个值时拒绝 限制截获的请求被重放的时间
+	maxSignatureSkew = 5 * time.Minute
+
+	defaultCertReloadInterval = 10 * time.Second
+)
+
+// 节点间TLS的配置
+// 同一个证书既是服务端证书 也是mTLS中的客户端证书 peer地址需要使用https://
+// unix://的peer不经过TLS 需要认证时使用SharedSecret 自己是unix://地址时不能设置RequireClientCert
+type TLSOptions struct {
+	CertFile string // PEM格式的证书
+	KeyFile  string // PEM格式的私钥
+	// 验证对方证书的CA 为空时使用系统的CA 修改之后需要重启
+	CAFile string
+	// 服务端要求客户端出示CAFile签发的证书(mTLS)
+	RequireClientCert bool
+	// 检查证书文件是否变化的间隔 默认10秒
+	ReloadInterval time.Duration
+}
+
+// 证书文件变化之后重新加载 握手时调用get 最多每隔interval检查一次文件的修改时间
+type certReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+	stats             *PoolStats
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // 两个文件中较新的修改时间
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration, stats *PoolStats) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval, stats: stats}
+	modTime, err := c.modified()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.cert, c.modTime, c.checked = &cert, modTime, time.Now()
+	return c, nil
+}
+
+func (c *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// 当前的证书 加载新证书失败时继续使用旧的
+func (c *certReloader) get() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < c.interval {
+		return c.cert
+	}
+	c.checked = time.Now()
+	modTime, err := c.modified()
+	if err != nil || !modTime.After(c.modTime) {
+		return c.cert
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// 证书和私钥可能还没有全部写完 下次再试
+		return c.cert
+	}
+	c.cert, c.modTime = &cert, modTime
+	c.stats.CertReloads.Add(1)
+	return c.cert
+}
+
+// 按配置创建服务端和客户端的tls.Config
+func (hp *HTTPPool) setupTLS() error {
+	o := hp.opts.TLS
+	if o.ReloadInterval == 0 {
+		o.ReloadInterval = defaultCertReloadInterval
+	}
+	certs, err := newCertReloader(o.CertFile, o.KeyFile, o.ReloadInterval, &hp.Stats)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %v", err)
+	}
+
+	var pool *x509.CertPool
+	if o.CAFile != "" {
+		data, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return fmt.Errorf("loading TLS CA: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in %s", o.CAFile)
+		}
+	}
+
+	hp.serverTLS = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.get(), nil
+		},
+	}
+	if o.RequireClientCert {
+		// 握手时只验证客户端出示的证书 没有证书的请求在ServeHTTP中拒绝并计数
+		hp.serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+		hp.serverTLS.ClientCAs = pool
+	}
+	hp.clientTLS = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.get(), nil
+		},
+	}
+	return nil
+}
+
+// 服务端使用的TLS配置 没有配置TLS时返回nil
+// 例如 http.Serve(tls.NewListener(l, hp.TLSConfig()), hp)
+func (hp *HTTPPool) TLSConfig() *tls.Config {
+	return hp.serverTLS
+}
+
+// 是否配置了认证 没有时任何能访问到端口的人都可以发送请求
+func (hp *HTTPPool) authRequired() bool {
+	return len(hp.opts.SharedSecret) > 0 || hp.opts.TLS != nil && hp.opts.TLS.RequireClientCert
+}
+
+// 检查来自peer的请求 未通过时返回原因
+func (hp *HTTPPool) authenticate(r *http.Request) error {
+	if o := hp.opts.TLS; o != nil && o.RequireClientCert {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return errors.New("no verified client certificate")
+		}
+	}
+	if len(hp.opts.SharedSecret) == 0 {
+		return nil
+	}
+
+	ts := r.Header.Get(timestampHeader)
+	sig, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if ts == "" || err != nil || len(sig) == 0 {
+		return errors.New("missing signature")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("bad timestamp")
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return fmt.Errorf("timestamp skew %v", skew.Round(time.Second))
+	}
+	// 签名包括请求体 读出来之后放回去
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if !hmac.Equal(sig, hp.signature(r.Method, r.URL.RequestURI(), ts, body)) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// 给发往peer的请求签名 没有配置共享密钥时什么也不做
+func (hp *HTTPPool) sign(req *http.Request, body []byte) {
+	if len(hp.opts.SharedSecret) == 0 {
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set(signatureHeader, hex.EncodeToString(hp.signature(req.Method, req.URL.RequestURI(), ts, body)))
+}
+
+// HMAC-SHA256(method \n uri \n timestamp \n sha256(body))
+func (hp *HTTPPool) signature(method, uri, ts string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, hp.opts.SharedSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%x", method, uri, ts, sum)
+	return mac.Sum(nil)
+}
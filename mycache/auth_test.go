@@ -0,0 +1,227 @@
+package mycache
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	pb "mycache/mycachepb"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSharedSecret(t *testing.T) {
+	newTestGroup("auth-secret")
+	secret := []byte("s3cret")
+	a, addrA := newTestPool(t, &HTTPPoolOptions{SharedSecret: secret})
+	b, addrB := newTestPool(t, &HTTPPoolOptions{SharedSecret: secret})
+	c, _ := newTestPool(t, &HTTPPoolOptions{SharedSecret: []byte("wrong")})
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+	c.SetPeers(addrA, addrB)
+
+	res := &pb.Response{}
+	if err := a.httpGetters[addrB].Get(&pb.Request{Group: "auth-secret", Key: "Tom"}, res); err != nil || string(res.Value) != "630" {
+		t.Fatalf("signed request failed: %v", err)
+	}
+	if err := a.httpGetters[addrB].Write(&pb.WriteRequest{Group: "auth-secret", Key: "Jack", Value: []byte("600")}); err != nil {
+		t.Fatalf("signed write failed: %v", err)
+	}
+
+	// 没有签名
+	res2, err := http.Get(addrB + defaultBasePath + "auth-secret/Tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2.Body.Close()
+	if res2.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned request should be rejected, got %s", res2.Status)
+	}
+	// 密钥不同
+	if err := c.httpGetters[addrB].Get(&pb.Request{Group: "auth-secret", Key: "Tom"}, res); err == nil {
+		t.Errorf("request signed with another secret should be rejected")
+	}
+	if b.Stats.AuthRejected.Get() != 2 {
+		t.Errorf("b should reject 2 requests, got %s", &b.Stats.AuthRejected)
+	}
+
+	// 健康检查不需要认证
+	res2, err = http.Get(addrB + healthPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2.Body.Close()
+	if res2.StatusCode != http.StatusOK {
+		t.Errorf("health check should not need a signature, got %s", res2.Status)
+	}
+}
+
+// 测试用的CA 签发证书写到dir下
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mycache test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, filepath.Join(ca.dir, "ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+// 签发127.0.0.1的证书 同时可以用作客户端证书
+func (ca *testCA) issue(t *testing.T, name string, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(ca.dir, name+".pem"), filepath.Join(ca.dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) {
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTLSTestPool(t *testing.T, opts *TLSOptions) (*HTTPPool, string) {
+	srv := httptest.NewUnstartedServer(nil)
+	t.Cleanup(srv.Close)
+	addr := "https://" + srv.Listener.Addr().String()
+	pool := newPool(t, addr, &HTTPPoolOptions{TLS: opts})
+	srv.Config.Handler = pool
+	// 不使用StartTLS 它会换上httptest自己的证书
+	srv.Listener = tls.NewListener(srv.Listener, pool.TLSConfig())
+	srv.Start()
+	return pool, addr
+}
+
+func TestMutualTLS(t *testing.T) {
+	newTestGroup("auth-tls")
+	ca := newTestCA(t)
+	certA, keyA := ca.issue(t, "a", 2)
+	certB, keyB := ca.issue(t, "b", 3)
+	caFile := filepath.Join(ca.dir, "ca.pem")
+
+	a, addrA := newTLSTestPool(t, &TLSOptions{CertFile: certA, KeyFile: keyA, CAFile: caFile, RequireClientCert: true})
+	b, addrB := newTLSTestPool(t, &TLSOptions{CertFile: certB, KeyFile: keyB, CAFile: caFile, RequireClientCert: true, ReloadInterval: time.Millisecond})
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+
+	res := &pb.Response{}
+	if err := a.httpGetters[addrB].Get(&pb.Request{Group: "auth-tls", Key: "Tom"}, res); err != nil || string(res.Value) != "630" {
+		t.Fatalf("get over mTLS failed: %v", err)
+	}
+
+	// 信任CA但没有客户端证书
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	res2, err := client.Get(addrB + defaultBasePath + "auth-tls/Tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2.Body.Close()
+	if res2.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without a client certificate should be rejected, got %s", res2.Status)
+	}
+	if b.Stats.AuthRejected.Get() != 1 {
+		t.Errorf("b should reject 1 request, got %s", &b.Stats.AuthRejected)
+	}
+
+	// 替换b的证书 新的连接使用新证书
+	time.Sleep(10 * time.Millisecond)
+	ca.issue(t, "b", 4)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certB, later, later)
+	os.Chtimes(keyB, later, later)
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := tls.Dial("tcp", addrB[len("https://"):], &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := conn.ConnectionState().PeerCertificates[0].SerialNumber
+	conn.Close()
+	if serial.Int64() != 4 {
+		t.Errorf("b should serve the reloaded certificate, got serial %v", serial)
+	}
+	if b.Stats.CertReloads.Get() != 1 {
+		t.Errorf("b should reload the certificate once, got %s", &b.Stats.CertReloads)
+	}
+}
+
+func TestBadTLSConfig(t *testing.T) {
+	if _, err := NewHTTPPoolOpts("https://localhost:4", &HTTPPoolOptions{TLS: &TLSOptions{CertFile: "missing.pem", KeyFile: "missing-key.pem"}}); err == nil {
+		t.Error("missing certificate should be reported")
+	}
+	// unix socket上没有客户端证书
+	if _, err := NewHTTPPoolOpts("unix:///tmp/mycache.sock", &HTTPPoolOptions{TLS: &TLSOptions{RequireClientCert: true}}); err == nil {
+		t.Error("RequireClientCert on a unix socket should be rejected")
+	}
+}
+
+// 签名需要读出请求体 超过上限时返回413 不会全部读入内存
+func TestRequestBodyLimit(t *testing.T) {
+	_, addr := newTestPool(t, &HTTPPoolOptions{SharedSecret: []byte("s3cret"), MaxRequestBytes: 1 << 10})
+	req, _ := http.NewRequest(http.MethodPost, addr+defaultBasePath+handoffPath, bytes.NewReader(make([]byte, 2<<10)))
+	req.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(signatureHeader, "00")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body should be rejected with 413, got %s", res.Status)
+	}
+}
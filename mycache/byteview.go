@@ -4,6 +4,11 @@ package mycache
 作为只读缓存值的抽象，同时实现读取长度、拷贝的方法
 */
 
+import (
+	"bytes"
+	"io"
+)
+
 // 封装一个字节数组用来表示缓存
 type ByteView struct {
 	bytes []byte
@@ -25,6 +30,17 @@ func (bv ByteView) String() string {
 	return string(bv.bytes)
 }
 
+// 只读的Reader 不拷贝数据 适合较大的值
+func (bv ByteView) Reader() io.Reader {
+	return bytes.NewReader(bv.bytes)
+}
+
+// 实现io.WriterTo 直接写出缓存的数据 不拷贝
+func (bv ByteView) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(bv.bytes)
+	return int64(n), err
+}
+
 func cloneBytes(bytes []byte) []byte {
 	tmp := make([]byte, len(bytes))
 	copy(tmp, bytes)
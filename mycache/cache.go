@@ -6,17 +6,28 @@ cache.go 中 封装了缓存的Add和Get方法以及添加了互斥锁
 */
 
 import (
+	"log"
 	"mycache/lru"
 	"sync"
+	"sync/atomic"
 )
 
 type mainCache struct {
-	mu         sync.Mutex
-	lru        *lru.Cache
-	cacheBytes int64
+	mu            sync.Mutex
+	lru           *lru.Cache
+	cacheBytes    int64
+	compressAbove atomic.Int64 // 不小于这个大小的值压缩保存 0表示不压缩
 }
 
 func (mc *mainCache) Add(key string, value ByteView) {
+	// 压缩比较慢 在加锁之前完成
+	var stored interface{ Len() int } = value
+	if above := mc.compressAbove.Load(); above > 0 && int64(value.Len()) >= above {
+		if cv, ok := compressView(value); ok {
+			stored = cv
+		}
+	}
+
 	mc.mu.Lock()
 	defer mc.mu.Unlock()
 
@@ -24,19 +35,71 @@ func (mc *mainCache) Add(key string, value ByteView) {
 		// 延迟初始化，减少程序内存开销
 		mc.lru = lru.New(mc.cacheBytes, nil, 1)
 	}
-	mc.lru.Add(key, value)
+	mc.lru.Add(key, stored)
+}
+
+// 缓存中可能是压缩保存的值 在锁外解压
+func toView(v interface{}) (ByteView, error) {
+	if cv, ok := v.(compressedView); ok {
+		return cv.view()
+	}
+	return v.(ByteView), nil
 }
 
 func (mc *mainCache) Get(key string) (value ByteView, ok bool) {
 	mc.mu.Lock()
-	defer mc.mu.Unlock()
-
 	if mc.lru == nil {
+		mc.mu.Unlock()
+		return
+	}
+	v, ok := mc.lru.Get(key)
+	mc.mu.Unlock()
+	if !ok {
 		return
 	}
 
-	if cv, ok := mc.lru.Get(key); ok {
-		return cv.(ByteView), ok
+	value, err := toView(v)
+	if err != nil {
+		// 无法解压的值当作未命中 从缓存中移除 之后重新加载
+		log.Printf("[MyCache] drop %s: %v", key, err)
+		mc.remove(key)
+		return ByteView{}, false
+	}
+	return value, true
+}
+
+func (mc *mainCache) remove(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.lru != nil {
+		mc.lru.Remove(key)
+	}
+}
+
+// 按最近使用的顺序返回缓存中的所有条目 无法解压的条目被跳过
+func (mc *mainCache) entries() (keys []string, values []ByteView) {
+	var raw []interface{}
+	mc.mu.Lock()
+	if mc.lru != nil {
+		mc.lru.Range(func(key string, value interface{ Len() int }) bool {
+			keys = append(keys, key)
+			raw = append(raw, value)
+			return true
+		})
+	}
+	mc.mu.Unlock()
+
+	n := 0
+	for i, v := range raw {
+		value, err := toView(v)
+		if err != nil {
+			log.Printf("[MyCache] skip %s: %v", keys[i], err)
+			continue
+		}
+		keys[n] = keys[i]
+		values = append(values, value)
+		n++
 	}
-	return
+	return keys[:n], values
 }
@@ -0,0 +1,118 @@
+package mycache
+
+// 向peer发送请求使用的http client
+// 默认的http.DefaultClient没有超时 每个host只保留2个空闲连接 负载高时会不断新建连接
+// 所有getter共用同一个client 连接池按peer复用
+// 每个peer的连接情况通过httptrace统计
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+const (
+	defaultRequestTimeout      = 5 * time.Second
+	defaultDialTimeout         = 2 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultMaxIdleConnsPerHost = 64
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// 向某个peer发送请求时的连接统计
+type PeerConnStats struct {
+	Requests    AtomicInt // 发出的请求数
+	NewConns    AtomicInt // 新建的连接数
+	ReusedConns AtomicInt // 复用的连接数
+	DialErrors  AtomicInt // 建立连接失败的次数
+	DialNanos   AtomicInt // 建立连接的总耗时
+}
+
+// 自定义的client需要自己配置TLS
+func newPeerClient(o *HTTPPoolOptions, tlsConfig *tls.Config) *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	dialer := &net.Dialer{
+		Timeout:   o.DialTimeout,
+		KeepAlive: o.KeepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:               unixAwareProxy,
+		DialContext:         unixAwareDial(dialer.DialContext),
+		MaxIdleConns:        o.MaxIdleConnsPerHost * 16,
+		MaxIdleConnsPerHost: o.MaxIdleConnsPerHost,
+		IdleConnTimeout:     o.IdleConnTimeout,
+		TLSHandshakeTimeout: o.DialTimeout,
+		TLSClientConfig:     tlsConfig,
+	}
+	return &http.Client{Transport: transport, Timeout: o.RequestTimeout}
+}
+
+// 每个peer的连接统计
+func (hp *HTTPPool) PeerConnStats() map[string]*PeerConnStats {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	stats := make(map[string]*PeerConnStats, len(hp.connStats))
+	for peer, s := range hp.connStats {
+		stats[peer] = s
+	}
+	return stats
+}
+
+// peer的连接统计 节点列表变化时保留 调用时需持有hp.mu
+func (hp *HTTPPool) connStatsLocked(peer string) *PeerConnStats {
+	if hp.connStats == nil {
+		hp.connStats = make(map[string]*PeerConnStats)
+	}
+	s, ok := hp.connStats[peer]
+	if !ok {
+		s = &PeerConnStats{}
+		hp.connStats[peer] = s
+	}
+	return s
+}
+
+// 使用pool的client发送请求 记录连接统计 body用于签名
+func (hg *httpGetter) do(req *http.Request, body []byte) (*http.Response, error) {
+	hg.pool.sign(req, body)
+	if s := hg.conn; s != nil {
+		s.Requests.Add(1)
+		var dialStart time.Time
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if info.Reused {
+					s.ReusedConns.Add(1)
+				} else {
+					s.NewConns.Add(1)
+				}
+			},
+			ConnectStart: func(network, addr string) {
+				dialStart = time.Now()
+			},
+			ConnectDone: func(network, addr string, err error) {
+				if err != nil {
+					s.DialErrors.Add(1)
+					return
+				}
+				s.DialNanos.Add(int64(time.Since(dialStart)))
+			},
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+	return hg.pool.client.Do(req)
+}
+
+// POST <baseURL><path> body是编码好的protobuf
+func (hg *httpGetter) post(path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, hg.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return hg.do(req, body)
+}
@@ -0,0 +1,139 @@
+package mycache
+
+// 压缩
+// 1. peer之间的响应：请求带上 Accept-Encoding: gzip, deflate 超过 CompressThreshold 的响应按对方支持的方式压缩
+// 2. 缓存中的值：group开启之后 超过阈值的值在mainCache中压缩保存 读取时再解压 同样的cacheBytes可以放下更多的值
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultCompressThreshold = 1 << 10
+	acceptEncoding           = "gzip, deflate"
+)
+
+// 按请求的Accept-Encoding选择压缩方式 小于阈值或对方不支持时原样写出
+// 返回的close需要在写完之后调用
+func (hp *HTTPPool) compressWriter(w http.ResponseWriter, r *http.Request, size int) (io.Writer, func() error) {
+	if hp.opts.CompressThreshold < 0 || size < hp.opts.CompressThreshold {
+		return w, func() error { return nil }
+	}
+
+	accept := r.Header.Get("Accept-Encoding")
+	cw := &countingWriter{w: w} // 统计压缩后的大小
+	var zw io.WriteCloser
+	switch {
+	case strings.Contains(accept, "gzip"):
+		zw, _ = gzip.NewWriterLevel(cw, gzip.BestSpeed)
+		w.Header().Set("Content-Encoding", "gzip")
+	case strings.Contains(accept, "deflate"):
+		zw, _ = flate.NewWriter(cw, flate.BestSpeed)
+		w.Header().Set("Content-Encoding", "deflate")
+	default:
+		return w, func() error { return nil }
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	hp.Stats.CompressedResponses.Add(1)
+	hp.Stats.UncompressedBytes.Add(int64(size))
+	return zw, func() error {
+		err := zw.Close()
+		hp.Stats.CompressedBytes.Add(cw.n)
+		return err
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// 按Content-Encoding解压响应 解压之后的长度未知
+func decodeBody(res *http.Response) error {
+	var rc io.ReadCloser
+	switch res.Header.Get("Content-Encoding") {
+	case "":
+		return nil
+	case "gzip":
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return err
+		}
+		rc = zr
+	case "deflate":
+		rc = flate.NewReader(res.Body)
+	default:
+		return nil
+	}
+	res.Body = &decodedBody{ReadCloser: rc, raw: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return nil
+}
+
+type decodedBody struct {
+	io.ReadCloser
+	raw io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.raw.Close()
+}
+
+// 在mainCache中压缩保存的值 Len是压缩后的大小
+type compressedView struct {
+	data []byte
+	size int // 解压后的大小
+}
+
+func (c compressedView) Len() int {
+	return len(c.data)
+}
+
+func (c compressedView) view() (ByteView, error) {
+	value := make([]byte, 0, c.size)
+	buf := bytes.NewBuffer(value)
+	zr := flate.NewReader(bytes.NewReader(c.data))
+	defer zr.Close()
+	if _, err := io.Copy(buf, zr); err != nil {
+		return ByteView{}, fmt.Errorf("decompress cached value: %w", err)
+	}
+	if buf.Len() != c.size {
+		return ByteView{}, fmt.Errorf("decompress cached value: got %d bytes, want %d", buf.Len(), c.size)
+	}
+	return ByteView{bytes: buf.Bytes()}, nil
+}
+
+// 压缩之后更小才使用压缩的结果
+func compressView(v ByteView) (compressedView, bool) {
+	var buf bytes.Buffer
+	zw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	zw.Write(v.bytes)
+	zw.Close()
+	if buf.Len() >= v.Len() {
+		return compressedView{}, false
+	}
+	return compressedView{data: buf.Bytes(), size: v.Len()}, true
+}
+
+// 不小于threshold字节的值在缓存中压缩保存 读取时解压 0表示不压缩
+// 需要在使用group之前设置
+func (g *Group) SetCompression(threshold int) {
+	g.mcache.compressAbove.Store(int64(threshold))
+}
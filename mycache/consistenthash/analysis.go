@@ -0,0 +1,70 @@
+package consistenthash
+
+// 对放置策略进行分析：负载是否均衡、节点变化时有多少key需要迁移
+
+import "math"
+
+// 统计每个节点负责的key数量
+func Ownership(p Placement, keys []string) map[string]int {
+	owners := make(map[string]int)
+	for _, key := range keys {
+		owners[p.Get(key)]++
+	}
+	return owners
+}
+
+// 统计前后两种放置之间归属发生变化的key数量
+func Moved(before, after Placement, keys []string) int {
+	moved := 0
+	for _, key := range keys {
+		if before.Get(key) != after.Get(key) {
+			moved++
+		}
+	}
+	return moved
+}
+
+// 变化之后每个节点的冷启动未命中数 也就是迁移到该节点的不同key的数量
+// keys可以是访问日志 重复的key只在变化之后的第一次访问时未命中 之后就命中了
+func ColdMisses(before, after Placement, keys []string) map[string]int {
+	misses := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		owner := after.Get(key)
+		if seen[key] || before.Get(key) == owner {
+			continue
+		}
+		seen[key] = true
+		misses[owner]++
+	}
+	return misses
+}
+
+// 负载均衡程度：返回 最大负载/平均负载 以及 标准差/平均负载
+// nodes中没有分到key的节点也计算在内
+func Balance(owners map[string]int, nodes []string) (maxOverMean, stddevOverMean float64) {
+	if len(nodes) == 0 {
+		return 0, 0
+	}
+
+	total, max := 0, 0
+	for _, node := range nodes {
+		total += owners[node]
+		if owners[node] > max {
+			max = owners[node]
+		}
+	}
+	mean := float64(total) / float64(len(nodes))
+	if mean == 0 {
+		return 0, 0
+	}
+
+	var variance float64
+	for _, node := range nodes {
+		d := float64(owners[node]) - mean
+		variance += d * d
+	}
+	variance /= float64(len(nodes))
+
+	return float64(max) / mean, math.Sqrt(variance) / mean
+}
@@ -12,6 +12,7 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
 )
@@ -21,37 +22,121 @@ import (
 type Hash func(data []byte) uint32
 
 type ConsistentHash struct {
-	hashfn      Hash
+	hashfn      Hash64 // 32位的hash函数也统一转换成64位
+	bits        uint   // 环的大小为2^bits 32或64
+	version     string // 算法标识 使用不同算法的peer不能混用
 	replicas    int
-	ring        []int // 为了之后排序
-	dummyToreal map[int]string
+	ring        []uint64 // 为了之后排序
+	dummyToreal map[uint64]string
+	nodes       []string // 真实节点 用于计算平均负载
+	collisions  []Collision
 }
 
-// 初始化一致性哈希
+// 两个虚拟节点hash到同一个位置
+type Collision struct {
+	Hash   uint64 // 冲突的位置
+	Winner string // 占据该位置的真实节点
+	Loser  string // 被挤掉的真实节点
+}
+
+// 初始化一致性哈希 2^32大小的环
 func New(replicas int, fn Hash) *ConsistentHash {
-	ch := &ConsistentHash{
-		replicas:    replicas,
-		hashfn:      fn,
-		dummyToreal: make(map[int]string),
-	}
+	version := "custom32"
 	// 赋默认hash函数
-	if ch.hashfn == nil {
-		ch.hashfn = crc32.ChecksumIEEE
+	if fn == nil {
+		fn = crc32.ChecksumIEEE
+		version = CRC32
+	}
+
+	ch := newRing(replicas, func(data []byte) uint64 { return uint64(fn(data)) }, 32)
+	ch.version = version + ":" + strconv.Itoa(replicas)
+	return ch
+}
+
+// 初始化一致性哈希 2^64大小的环
+// 环越大虚拟节点越不容易冲突，节点很多时应当使用64位的环
+func New64(replicas int, fn Hash64) *ConsistentHash {
+	version := "custom64"
+	if fn == nil {
+		fn = defaultHash64
+		version = FNV1a64
 	}
 
+	ch := newRing(replicas, fn, 64)
+	ch.version = version + ":" + strconv.Itoa(replicas)
 	return ch
 }
 
+func newRing(replicas int, fn Hash64, bits uint) *ConsistentHash {
+	return &ConsistentHash{
+		replicas:    replicas,
+		hashfn:      fn,
+		bits:        bits,
+		dummyToreal: make(map[uint64]string),
+	}
+}
+
+// 环的版本 由hash算法和虚拟节点数组成
+func (ch *ConsistentHash) Version() string {
+	return ch.version
+}
+
 // 传入多个/一个 real node，然后创建replicas个dummy nodes
+// 两个虚拟节点hash值相同时，环上只保留一个位置，归属名字较小的真实节点
+// 这样无论节点以什么顺序加入，所有peer得到的环都是一样的
 func (ch *ConsistentHash) Add(nodes ...string) {
 	for _, node := range nodes {
-		for i := 0; i < ch.replicas; i++ {
-			hash := int(ch.hashfn([]byte(strconv.Itoa(i) + node))) // 将基数为10的数转换成字符串形式
+		ch.addNode(node, ch.replicas)
+	}
+	ch.sortRing()
+}
+
+// 按权重添加节点 虚拟节点数为 replicas×weight，权重越大负责的key越多
+func (ch *ConsistentHash) AddWeighted(node string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	ch.addNode(node, ch.replicas*weight)
+	ch.sortRing()
+}
+
+func (ch *ConsistentHash) addNode(node string, vnodes int) {
+	if ch.hasNode(node) {
+		return // 重复添加同一个节点
+	}
+	ch.nodes = append(ch.nodes, node)
+	for i := 0; i < vnodes; i++ {
+		hash := ch.hashfn([]byte(strconv.Itoa(i) + node)) // 将基数为10的数转换成字符串形式
+		owner, ok := ch.dummyToreal[hash]
+		if !ok {
 			ch.ring = append(ch.ring, hash)
 			ch.dummyToreal[hash] = node
+			continue
+		}
+		if owner == node {
+			continue // 同一个节点的两个虚拟节点冲突 不影响归属
+		}
+		// 不同节点冲突 名字较小的节点胜出
+		winner, loser := owner, node
+		if node < owner {
+			winner, loser = node, owner
+		}
+		ch.dummyToreal[hash] = winner
+		ch.collisions = append(ch.collisions, Collision{Hash: hash, Winner: winner, Loser: loser})
+	}
+}
+
+func (ch *ConsistentHash) sortRing() {
+	sort.Slice(ch.ring, func(i, j int) bool { return ch.ring[i] < ch.ring[j] })
+}
+
+func (ch *ConsistentHash) hasNode(node string) bool {
+	for _, n := range ch.nodes {
+		if n == node {
+			return true
 		}
 	}
-	sort.Ints(ch.ring)
+	return false
 }
 
 func (ch *ConsistentHash) Get(key string) string {
@@ -60,7 +145,7 @@ func (ch *ConsistentHash) Get(key string) string {
 		return ""
 	}
 	// 不是空的 先获取key的hash值
-	hash := int(ch.hashfn([]byte(key)))
+	hash := ch.hashfn([]byte(key))
 	// 使用binary search 因为ring有序
 	// 找到第一个大于key的node
 	idx := sort.Search(len(ch.ring), func(i int) bool {
@@ -69,3 +154,106 @@ func (ch *ConsistentHash) Get(key string) string {
 	// idx只是一个索引 realToDummy的key是hash值，也就是ring上的值，需要进行转换
 	return ch.dummyToreal[ch.ring[idx%len(ch.ring)]]
 }
+
+// 从key的位置顺时针返回最多n个不同的真实节点 第一个就是Get的结果
+// owner不可用时 后面的节点就是它的后继
+func (ch *ConsistentHash) GetN(key string, n int) []string {
+	if len(ch.ring) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(ch.nodes) {
+		n = len(ch.nodes)
+	}
+
+	hash := ch.hashfn([]byte(key))
+	idx := sort.Search(len(ch.ring), func(i int) bool {
+		return ch.ring[i] >= hash
+	})
+
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(ch.ring) && len(nodes) < n; i++ {
+		node := ch.dummyToreal[ch.ring[(idx+i)%len(ch.ring)]]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// 有界负载的一致性哈希 (Mirrokni et al. Consistent Hashing with Bounded Loads)
+// 虚拟节点只能缓解节点分布不均，热点key仍然会压垮单个节点
+// 每个节点的容量为 ceil((1+ε) × 平均负载)，平均负载按 (总负载+1)/节点数 计算（+1是即将分配的这次请求）
+// 从key的位置顺时针查找，跳过负载已经达到容量的节点
+// load 返回节点当前的在途请求数，由调用方维护
+func (ch *ConsistentHash) GetBounded(key string, epsilon float64, load func(node string) int64) string {
+	if len(ch.ring) == 0 {
+		return ""
+	}
+
+	var total int64
+	for _, node := range ch.nodes {
+		total += load(node)
+	}
+	capacity := int64(math.Ceil((1 + epsilon) * float64(total+1) / float64(len(ch.nodes))))
+
+	hash := ch.hashfn([]byte(key))
+	idx := sort.Search(len(ch.ring), func(i int) bool {
+		return ch.ring[i] >= hash
+	})
+
+	// 同一个真实节点在环上出现多次 只需要检查一次
+	checked := make(map[string]bool, len(ch.nodes))
+	for i := 0; i < len(ch.ring) && len(checked) < len(ch.nodes); i++ {
+		node := ch.dummyToreal[ch.ring[(idx+i)%len(ch.ring)]]
+		if checked[node] {
+			continue
+		}
+		checked[node] = true
+		if load(node) < capacity {
+			return node
+		}
+	}
+
+	// 理论上不会走到这里 至少有一个节点低于平均负载
+	return ch.dummyToreal[ch.ring[idx%len(ch.ring)]]
+}
+
+// 哈希环的健康状况
+type RingHealth struct {
+	VirtualNodes int                // 环上实际的虚拟节点数
+	Collisions   []Collision        // 发生过的虚拟节点冲突
+	Coverage     map[string]float64 // 每个真实节点负责的哈希空间比例 总和为1
+}
+
+// 检查哈希环：虚拟节点冲突以及每个真实节点覆盖的弧长
+// 覆盖比例明显偏离 1/节点数 说明hash函数或虚拟节点数不合适
+func (ch *ConsistentHash) Health() RingHealth {
+	health := RingHealth{
+		VirtualNodes: len(ch.ring),
+		Collisions:   append([]Collision(nil), ch.collisions...),
+		Coverage:     make(map[string]float64, len(ch.nodes)),
+	}
+	for _, node := range ch.nodes {
+		health.Coverage[node] = 0
+	}
+	if len(ch.ring) == 0 {
+		return health
+	}
+
+	// 每个虚拟节点负责 (前一个虚拟节点, 自己] 这段弧
+	space := math.Ldexp(1, int(ch.bits))
+	mask := uint64(math.MaxUint64) >> (64 - ch.bits)
+	prev := ch.ring[len(ch.ring)-1] // 第一个虚拟节点的弧从环尾绕回来
+	for _, hash := range ch.ring {
+		arc := (hash - prev) & mask // 无符号减法自动处理回绕
+		if len(ch.ring) == 1 {
+			arc = mask // 只有一个虚拟节点时负责整个环
+		}
+		health.Coverage[ch.dummyToreal[hash]] += float64(arc) / space
+		prev = hash
+	}
+
+	return health
+}
@@ -41,3 +41,136 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestBoundedLoads(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	// 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.Add("6", "4", "2")
+
+	loads := map[string]int64{}
+	load := func(node string) int64 { return loads[node] }
+
+	// 没有负载时与Get一致
+	if got := hash.GetBounded("11", 0.25, load); got != "2" {
+		t.Errorf("Asking for 11 without load, should have yielded 2, got %s", got)
+	}
+
+	// 总负载6 容量为 ceil(1.25*7/3)=3，节点2已满 顺时针下一个是4
+	loads["2"] = 3
+	loads["4"] = 2
+	loads["6"] = 1
+	if got := hash.GetBounded("11", 0.25, load); got != "4" {
+		t.Errorf("Asking for 11 with node 2 overloaded, should have yielded 4, got %s", got)
+	}
+
+	// 节点4也满了 继续找到6
+	loads["4"] = 3
+	loads["6"] = 0
+	if got := hash.GetBounded("11", 0.25, load); got != "6" {
+		t.Errorf("Asking for 11 with nodes 2 and 4 overloaded, should have yielded 6, got %s", got)
+	}
+}
+
+func TestCollisions(t *testing.T) {
+	newHash := func() *ConsistentHash {
+		return New(3, func(key []byte) uint32 {
+			i, _ := strconv.Atoi(string(key))
+			return uint32(i)
+		})
+	}
+
+	// "6" 的虚拟节点为 6, 16, 26；"16" 的虚拟节点为 16, 116, 216，在16处冲突
+	a, b := newHash(), newHash()
+	a.Add("6", "16")
+	b.Add("16", "6")
+
+	for _, key := range []string{"10", "16", "100", "200"} {
+		if a.Get(key) != b.Get(key) {
+			t.Errorf("Asking for %s, got %s and %s depending on insertion order", key, a.Get(key), b.Get(key))
+		}
+	}
+	if got := a.Get("10"); got != "16" {
+		t.Errorf("Asking for 10, should have yielded 16, got %s", got)
+	}
+
+	health := a.Health()
+	if health.VirtualNodes != 5 {
+		t.Errorf("ring should hold 5 virtual nodes, got %d", health.VirtualNodes)
+	}
+	if len(health.Collisions) != 1 || health.Collisions[0] != (Collision{Hash: 16, Winner: "16", Loser: "6"}) {
+		t.Errorf("unexpected collisions %v", health.Collisions)
+	}
+	var total float64
+	for _, c := range health.Coverage {
+		total += c
+	}
+	if total < 0.999999 || total > 1.000001 {
+		t.Errorf("coverage should sum to 1, got %v", total)
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	nodes := []string{"http://localhost:8001", "http://localhost:8002", "http://localhost:8003"}
+	for _, name := range []string{CRC32, FNV1a64, CRC64} {
+		ch, err := NewAlgorithm(name, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch.Add(nodes...)
+		if got := ch.Version(); got != name+":50" {
+			t.Errorf("%s: unexpected version %s", name, got)
+		}
+		for node, c := range ch.Health().Coverage {
+			if c <= 0 || c >= 1 {
+				t.Errorf("%s: node %s covers %.3f of the ring", name, node, c)
+			}
+		}
+	}
+
+	if _, err := NewAlgorithm("md5", 50); err == nil {
+		t.Errorf("unknown algorithm should be rejected")
+	}
+}
+
+func TestAddWeighted(t *testing.T) {
+	ch := New64(50, nil)
+	ch.AddWeighted("http://localhost:8001", 3)
+	ch.AddWeighted("http://localhost:8002", 1)
+
+	health := ch.Health()
+	if health.VirtualNodes != 200 {
+		t.Errorf("ring should hold 200 virtual nodes, got %d", health.VirtualNodes)
+	}
+	if health.Coverage["http://localhost:8001"] < 0.6 {
+		t.Errorf("node with weight 3 should cover most of the ring, got %.3f", health.Coverage["http://localhost:8001"])
+	}
+}
+
+func TestGetN(t *testing.T) {
+	ch := New(10, nil)
+	ch.Add("a", "b", "c")
+
+	for _, key := range []string{"Tom", "Jack", "Sam", "Kate"} {
+		nodes := ch.GetN(key, 5)
+		if len(nodes) != 3 || nodes[0] != ch.Get(key) {
+			t.Fatalf("GetN(%s) = %v, want 3 distinct nodes starting with %s", key, nodes, ch.Get(key))
+		}
+		if nodes[0] == nodes[1] || nodes[1] == nodes[2] || nodes[0] == nodes[2] {
+			t.Fatalf("GetN(%s) returned duplicates: %v", key, nodes)
+		}
+
+		// 去掉owner之后 key应该落到它的后继上
+		rest := New(10, nil)
+		for _, n := range []string{"a", "b", "c"} {
+			if n != nodes[0] {
+				rest.Add(n)
+			}
+		}
+		if rest.Get(key) != nodes[1] {
+			t.Errorf("successor of %s should be %s, got %s", key, rest.Get(key), nodes[1])
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package consistenthash
+
+// 内置的hash算法
+// crc32 对 strconv.Itoa(i)+node 这类只有少数字符不同的输入分布很差
+// 例如 http://localhost:8001 ~ 8003 的虚拟节点会扎堆，64位算法在hash之后再做一次混合
+
+import (
+	"fmt"
+	"hash/crc64"
+)
+
+const (
+	CRC32   = "crc32"   // 2^32的环 默认算法 兼容旧版本
+	FNV1a64 = "fnv1a64" // 2^64的环 FNV-1a 64
+	CRC64   = "crc64"   // 2^64的环 CRC-64/ECMA 长key时比FNV更快
+)
+
+// 没有提供 hash/maphash：它的种子只能随机生成，不同进程之间结果不同，
+// 而一致性哈希要求所有peer对同一个key算出相同的值
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+func crc64Hash(data []byte) uint64 {
+	return mix64(crc64.Checksum(data, crc64Table))
+}
+
+// 根据算法名创建哈希环
+func NewAlgorithm(name string, replicas int) (*ConsistentHash, error) {
+	switch name {
+	case "", CRC32:
+		return New(replicas, nil), nil
+	case FNV1a64:
+		return New64(replicas, nil), nil
+	case CRC64:
+		ch := New64(replicas, crc64Hash)
+		ch.version = fmt.Sprintf("%s:%d", CRC64, replicas)
+		return ch, nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", name)
+}
@@ -0,0 +1,50 @@
+package consistenthash
+
+// Jump consistent hash (Lamping & Veach)
+// 不需要额外内存，分布几乎完美均匀，但节点只能用编号[0, n)表示
+// 只有在末尾追加节点时迁移量才是最小的，中间插入或删除节点会导致大量key迁移
+// 为了让所有peer在节点列表顺序不同时也能得到相同结果，这里按节点名排序后编号
+
+import "sort"
+
+type Jump struct {
+	hashfn  Hash64
+	version string
+	nodes   []string
+}
+
+func NewJump(fn Hash64) *Jump {
+	j := &Jump{hashfn: fn, version: "jump:" + hashVersion(fn)}
+	if j.hashfn == nil {
+		j.hashfn = defaultHash64
+	}
+	return j
+}
+
+func (j *Jump) Add(nodes ...string) {
+	j.nodes = append(j.nodes, nodes...)
+	sort.Strings(j.nodes)
+}
+
+// 由算法名和hash函数组成
+func (j *Jump) Version() string {
+	return j.version
+}
+
+func (j *Jump) Get(key string) string {
+	if len(j.nodes) == 0 {
+		return ""
+	}
+	return j.nodes[jumpHash(j.hashfn([]byte(key)), len(j.nodes))]
+}
+
+// 论文中的原始算法
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,109 @@
+package consistenthash
+
+// Maglev哈希 (Google Maglev: A Fast and Reliable Software Network Load Balancer)
+// 每个节点根据自己的offset和skip生成一个排列，轮流在查找表中占位，直到填满
+// 查找是O(1)，分布非常均匀；节点变化时迁移量略高于哈希环，但仍然很小
+// 查找表大小需要是质数，并且远大于节点数
+
+import (
+	"sort"
+	"strconv"
+)
+
+// 默认的查找表大小
+const defaultMaglevSize = 65537
+
+type Maglev struct {
+	hashfn   Hash64
+	hashName string // hash函数在版本中的名字
+	size     uint64
+	nodes    []string
+	table    []int // 查找表 元素为nodes的下标
+}
+
+// size为0时使用默认值65537 不是质数时向上取到下一个质数
+// 否则某些节点的排列不能覆盖整张表 填表永远不会结束
+func NewMaglev(size int, fn Hash64) *Maglev {
+	m := &Maglev{hashfn: fn, hashName: hashVersion(fn), size: uint64(size)}
+	if m.hashfn == nil {
+		m.hashfn = defaultHash64
+	}
+	if size <= 0 {
+		m.size = defaultMaglevSize
+	}
+	m.size = nextPrime(m.size)
+	return m
+}
+
+// 不小于n的最小质数 n很小 试除就足够了
+func nextPrime(n uint64) uint64 {
+	if n < 2 {
+		return 2
+	}
+	for ; ; n++ {
+		prime := true
+		for d := uint64(2); d*d <= n; d++ {
+			if n%d == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			return n
+		}
+	}
+}
+
+func (m *Maglev) Add(nodes ...string) {
+	m.nodes = append(m.nodes, nodes...)
+	// 填表时节点的先后顺序会影响结果 排序保证所有peer得到同一张表
+	sort.Strings(m.nodes)
+	m.populate()
+}
+
+// 由算法名、查找表大小和hash函数组成
+func (m *Maglev) Version() string {
+	return "maglev:" + strconv.FormatUint(m.size, 10) + ":" + m.hashName
+}
+
+func (m *Maglev) Get(key string) string {
+	if len(m.nodes) == 0 {
+		return ""
+	}
+	return m.nodes[m.table[m.hashfn([]byte(key))%m.size]]
+}
+
+// 生成查找表
+func (m *Maglev) populate() {
+	n := len(m.nodes)
+	offsets := make([]uint64, n)
+	skips := make([]uint64, n)
+	for i, node := range m.nodes {
+		h := m.hashfn([]byte(node))
+		offsets[i] = h % m.size
+		skips[i] = mix64(h)%(m.size-1) + 1
+	}
+
+	m.table = make([]int, m.size)
+	for i := range m.table {
+		m.table[i] = -1
+	}
+
+	next := make([]uint64, n) // 每个节点在自己排列中的位置
+	var filled uint64
+	for {
+		for i := 0; i < n; i++ {
+			c := (offsets[i] + next[i]*skips[i]) % m.size
+			for m.table[c] >= 0 {
+				next[i]++
+				c = (offsets[i] + next[i]*skips[i]) % m.size
+			}
+			m.table[c] = i
+			next[i]++
+			filled++
+			if filled == m.size {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package consistenthash
+
+// 抽象出key到节点的放置策略 HTTPPool不再依赖具体的一致性哈希实现
+// 目前提供的策略：
+// 1. ConsistentHash 带虚拟节点的哈希环（默认）
+// 2. Rendezvous     最高随机权重哈希（HRW）
+// 3. Jump           Jump consistent hash
+// 4. Maglev         Google Maglev的查找表
+
+import "hash/fnv"
+
+// key到节点的放置策略
+type Placement interface {
+	// 添加真实节点
+	Add(nodes ...string)
+	// 返回key对应的节点 没有节点时返回空字符串
+	Get(key string) string
+}
+
+var (
+	_ Placement = (*ConsistentHash)(nil)
+	_ Placement = (*Rendezvous)(nil)
+	_ Placement = (*Jump)(nil)
+	_ Placement = (*Maglev)(nil)
+)
+
+// 带版本的放置策略
+// 版本标识了算法、参数和hash函数 peer之间版本不同说明它们对key的归属有不同的看法 不能混用
+type Versioned interface {
+	Version() string
+}
+
+// 64位hash函数 新的放置策略都基于64位hash
+type Hash64 func(data []byte) uint64
+
+// hash函数在版本中的名字 与ConsistentHash一样 自定义的函数无法区分 统一记为custom64
+func hashVersion(fn Hash64) string {
+	if fn == nil {
+		return FNV1a64
+	}
+	return "custom64"
+}
+
+// 默认的64位hash FNV-1a之后再做一次混合，让相近的输入也能充分打散
+func defaultHash64(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return mix64(h.Sum64())
+}
+
+// splitmix64的finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,162 @@
+package consistenthash
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var placements = map[string]func() Placement{
+	"ring":       func() Placement { return New(50, nil) },
+	"ring64":     func() Placement { return New64(50, nil) },
+	"rendezvous": func() Placement { return NewRendezvous(nil) },
+	"jump":       func() Placement { return NewJump(nil) },
+	"maglev":     func() Placement { return NewMaglev(0, nil) },
+}
+
+// hash函数不同时版本也不同
+func TestPlacementVersion(t *testing.T) {
+	pairs := map[string][2]Versioned{
+		"rendezvous": {NewRendezvous(nil), NewRendezvous(crc64Hash)},
+		"jump":       {NewJump(nil), NewJump(crc64Hash)},
+		"maglev":     {NewMaglev(0, nil), NewMaglev(0, crc64Hash)},
+	}
+	for name, p := range pairs {
+		if p[0].Version() == p[1].Version() {
+			t.Errorf("%s: different hash functions share version %s", name, p[0].Version())
+		}
+	}
+}
+
+func testNodes(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("http://localhost:%d", 8001+i)
+	}
+	return nodes
+}
+
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+// 比较各种策略的负载均衡程度和扩容一个节点时的迁移比例
+// go test -v -run TestPlacementAnalysis 可以看到具体数据
+func TestPlacementAnalysis(t *testing.T) {
+	nodes := testNodes(10)
+	grown := testNodes(11)
+	keys := testKeys(100000)
+
+	for name, newPlacement := range placements {
+		before := newPlacement()
+		before.Add(nodes...)
+		after := newPlacement()
+		after.Add(grown...)
+
+		owners := Ownership(before, keys)
+		for owner := range owners {
+			if owner == "" {
+				t.Fatalf("%s: key mapped to no node", name)
+			}
+		}
+		maxOverMean, stddevOverMean := Balance(owners, nodes)
+		moved := float64(Moved(before, after, keys)) / float64(len(keys))
+
+		t.Logf("%-10s max/mean=%.3f stddev/mean=%.3f moved(10->11)=%.3f", name, maxOverMean, stddevOverMean, moved)
+
+		// 理想迁移比例为1/11 留出足够余量
+		if moved > 0.2 {
+			t.Errorf("%s: %.3f of keys moved when adding one node", name, moved)
+		}
+	}
+}
+
+// 所有peer的节点列表顺序可能不同 结果必须一致
+func TestPlacementOrderIndependent(t *testing.T) {
+	nodes := testNodes(5)
+	reversed := make([]string, len(nodes))
+	for i, node := range nodes {
+		reversed[len(nodes)-1-i] = node
+	}
+
+	for name, newPlacement := range placements {
+		a, b := newPlacement(), newPlacement()
+		a.Add(nodes...)
+		b.Add(reversed...)
+		if moved := Moved(a, b, testKeys(1000)); moved != 0 {
+			t.Errorf("%s: %d keys differ when nodes are added in another order", name, moved)
+		}
+	}
+}
+
+func BenchmarkPlacementGet(b *testing.B) {
+	nodes := testNodes(10)
+	keys := testKeys(1024)
+
+	for name, newPlacement := range placements {
+		p := newPlacement()
+		p.Add(nodes...)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p.Get(keys[i&1023])
+			}
+		})
+	}
+}
+
+// 查找表大小不是质数时向上取整 否则填表不会结束
+func TestMaglevSize(t *testing.T) {
+	tests := []struct {
+		size, want int
+	}{
+		{0, 65537},
+		{1, 2},
+		{2, 2},
+		{100, 101},
+		{65536, 65537},
+	}
+	for _, tt := range tests {
+		m := NewMaglev(tt.size, nil)
+		if m.size != uint64(tt.want) {
+			t.Errorf("size %d: got %d, want %d", tt.size, m.size, tt.want)
+			continue
+		}
+		nodes := testNodes(3)
+		m.Add(nodes...)
+		if node := m.Get("Tom"); node == "" {
+			t.Errorf("size %d: key should be placed", tt.size)
+		}
+	}
+}
+
+func TestColdMisses(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after []string
+		keys          []string
+		moved         int
+		cold          map[string]int
+	}{
+		{"unchanged", []string{"a", "b"}, []string{"b", "a"}, []string{"Tom", "Jack", "Sam"}, 0, map[string]int{}},
+		// 重复的key只冷启动一次
+		{"replaced", []string{"a"}, []string{"b"}, []string{"Tom", "Tom", "Tom", "Jack"}, 4, map[string]int{"b": 2}},
+		{"no keys", []string{"a"}, []string{"b"}, nil, 0, map[string]int{}},
+	}
+	for _, tt := range tests {
+		for name, newPlacement := range placements {
+			before, after := newPlacement(), newPlacement()
+			before.Add(tt.before...)
+			after.Add(tt.after...)
+			if moved := Moved(before, after, tt.keys); moved != tt.moved {
+				t.Errorf("%s/%s: moved %d, want %d", tt.name, name, moved, tt.moved)
+			}
+			if cold := ColdMisses(before, after, tt.keys); !reflect.DeepEqual(cold, tt.cold) {
+				t.Errorf("%s/%s: cold misses %v, want %v", tt.name, name, cold, tt.cold)
+			}
+		}
+	}
+}
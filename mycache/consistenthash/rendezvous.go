@@ -0,0 +1,50 @@
+package consistenthash
+
+// Rendezvous（Highest Random Weight）哈希
+// 对每个节点计算 score = hash(key, node)，得分最高的节点就是key的归属
+// 不需要虚拟节点就能做到均匀分布，节点变化时只有属于该节点的key会迁移
+// 代价是每次查找都是O(n)，适合节点数不多的集群
+
+type Rendezvous struct {
+	hashfn     Hash64
+	version    string
+	nodes      []string
+	nodeHashes []uint64 // 预先计算好的节点hash
+}
+
+func NewRendezvous(fn Hash64) *Rendezvous {
+	r := &Rendezvous{hashfn: fn, version: "rendezvous:" + hashVersion(fn)}
+	if r.hashfn == nil {
+		r.hashfn = defaultHash64
+	}
+	return r
+}
+
+func (r *Rendezvous) Add(nodes ...string) {
+	for _, node := range nodes {
+		r.nodes = append(r.nodes, node)
+		r.nodeHashes = append(r.nodeHashes, r.hashfn([]byte(node)))
+	}
+}
+
+// 由算法名和hash函数组成
+func (r *Rendezvous) Version() string {
+	return r.version
+}
+
+func (r *Rendezvous) Get(key string) string {
+	if len(r.nodes) == 0 {
+		return ""
+	}
+
+	keyHash := r.hashfn([]byte(key))
+	best, bestScore := 0, uint64(0)
+	for i, nh := range r.nodeHashes {
+		score := mix64(keyHash ^ nh)
+		// 得分相同时取名字较小的节点 保证与节点添加顺序无关
+		if i == 0 || score > bestScore || (score == bestScore && r.nodes[i] < r.nodes[best]) {
+			best, bestScore = i, score
+		}
+	}
+	return r.nodes[best]
+}
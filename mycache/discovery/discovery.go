@@ -0,0 +1,89 @@
+package discovery
+
+// 节点发现：从外部来源获取节点列表，变化时调用 HTTPPool.SetPeers
+// 1. FileWatcher 从JSON文件读取 文件变化或收到SIGHUP时重新加载
+// 2. DNSWatcher  定期解析域名的A/SRV记录
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// 通常就是 *mycache.HTTPPool
+type PeerSetter interface {
+	SetPeers(peers ...string)
+}
+
+// 支持权重的PeerSetter
+type WeightedPeerSetter interface {
+	SetWeightedPeers(weights map[string]int)
+}
+
+// 发现的节点 Weight为0时视为1
+type Peer struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// 记录上一次设置的节点 只有发生变化时才调用SetPeers
+type applier struct {
+	mu     sync.Mutex
+	name   string
+	setter PeerSetter
+	last   map[string]int
+}
+
+func (a *applier) apply(peers []Peer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	weights := make(map[string]int, len(peers))
+	weighted := false
+	for _, p := range peers {
+		if p.Weight <= 0 {
+			p.Weight = 1
+		}
+		if p.Weight != 1 {
+			weighted = true
+		}
+		weights[p.Addr] = p.Weight
+	}
+
+	added, removed, changed := diff(a.last, weights)
+	if a.last != nil && len(added)+len(removed)+len(changed) == 0 {
+		return
+	}
+	log.Printf("[Discovery %s] peers added %v, removed %v, reweighted %v", a.name, added, removed, changed)
+	a.last = weights
+
+	if ws, ok := a.setter.(WeightedPeerSetter); ok && weighted {
+		ws.SetWeightedPeers(weights)
+		return
+	}
+	addrs := make([]string, 0, len(weights))
+	for addr := range weights {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	a.setter.SetPeers(addrs...)
+}
+
+func diff(old, cur map[string]int) (added, removed, changed []string) {
+	for addr, w := range cur {
+		if ow, ok := old[addr]; !ok {
+			added = append(added, addr)
+		} else if ow != w {
+			changed = append(changed, addr)
+		}
+	}
+	for addr := range old {
+		if _, ok := cur[addr]; !ok {
+			removed = append(removed, addr)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return
+}
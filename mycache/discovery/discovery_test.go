@@ -0,0 +1,203 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	peers   []string
+	weights map[string]int
+	calls   int
+}
+
+func (r *recorder) SetPeers(peers ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers, r.weights = peers, nil
+	r.calls++
+}
+
+func (r *recorder) SetWeightedPeers(weights map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers, r.weights = nil, weights
+	r.calls++
+}
+
+func (r *recorder) get() ([]string, map[string]int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.peers, r.weights, r.calls
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"peers": [{"addr": "http://localhost:8002"}, {"addr": "http://localhost:8001"}]}`)
+
+	r := &recorder{}
+	w, err := WatchFile(path, r, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if peers, _, _ := r.get(); !reflect.DeepEqual(peers, []string{"http://localhost:8001", "http://localhost:8002"}) {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+
+	// 带权重
+	write(`{"peers": [{"addr": "http://localhost:8001", "weight": 2}, {"addr": "http://localhost:8003"}]}`)
+	want := map[string]int{"http://localhost:8001": 2, "http://localhost:8003": 1}
+	waitFor(t, "weighted reload", func() bool {
+		_, weights, _ := r.get()
+		return reflect.DeepEqual(weights, want)
+	})
+
+	// 格式错误 保留之前的节点
+	_, _, calls := r.get()
+	write(`{"peers": [`)
+	if err := w.Reload(); err == nil {
+		t.Fatal("broken file should fail to reload")
+	}
+	// 空的列表同样保留之前的节点
+	for _, s := range []string{`{"peers": []}`, `{}`} {
+		write(s)
+		if err := w.Reload(); err == nil {
+			t.Fatalf("%s should fail to reload", s)
+		}
+	}
+	// 内容不变 不重复调用SetPeers
+	write(`{"peers": [{"addr": "http://localhost:8003"}, {"addr": "http://localhost:8001", "weight": 2}]}`)
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, weights, n := r.get(); n != calls || !reflect.DeepEqual(weights, want) {
+		t.Fatalf("unchanged peers should not be applied again, calls %d -> %d, weights %v", calls, n, weights)
+	}
+}
+
+type fakeResolver struct {
+	mu    sync.Mutex
+	hosts []string
+	srvs  []*net.SRV
+	err   error
+}
+
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hosts, f.err
+}
+
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return name, f.srvs, f.err
+}
+
+func (f *fakeResolver) set(hosts []string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hosts, f.err = hosts, err
+}
+
+func TestWatchDNS(t *testing.T) {
+	resolver := &fakeResolver{hosts: []string{"10.0.0.2", "10.0.0.1"}}
+	r := &recorder{}
+	w, err := WatchDNS(DNSConfig{Name: "mycache.default.svc", Port: 8001, Interval: 10 * time.Millisecond, Resolver: resolver}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if peers, _, _ := r.get(); !reflect.DeepEqual(peers, []string{"http://10.0.0.1:8001", "http://10.0.0.2:8001"}) {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+
+	resolver.set([]string{"10.0.0.1", "10.0.0.3", "fd00::1"}, nil)
+	want := []string{"http://10.0.0.1:8001", "http://10.0.0.3:8001", "http://[fd00::1]:8001"}
+	waitFor(t, "refresh", func() bool {
+		peers, _, _ := r.get()
+		return reflect.DeepEqual(peers, want)
+	})
+
+	// 解析失败或者没有记录 保留之前的节点
+	resolver.set(nil, errors.New("SERVFAIL"))
+	if err := w.Refresh(); err == nil {
+		t.Fatal("failed lookup should be reported")
+	}
+	resolver.set(nil, nil)
+	if err := w.Refresh(); err == nil {
+		t.Fatal("empty lookup should be reported")
+	}
+	if peers, _, _ := r.get(); !reflect.DeepEqual(peers, want) {
+		t.Fatalf("peers should be kept, got %v", peers)
+	}
+}
+
+func TestWatchDNSSRV(t *testing.T) {
+	resolver := &fakeResolver{srvs: []*net.SRV{
+		{Target: "mycache-0.mycache.default.svc.", Port: 8001},
+		{Target: "mycache-1.mycache.default.svc.", Port: 8002},
+	}}
+	r := &recorder{}
+	w, err := WatchDNS(DNSConfig{Name: "_mycache._tcp.mycache.default.svc", SRV: true, Resolver: resolver}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	want := []string{"http://mycache-0.mycache.default.svc:8001", "http://mycache-1.mycache.default.svc:8002"}
+	if peers, _, _ := r.get(); !reflect.DeepEqual(peers, want) {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+}
+
+func TestSelfAddr(t *testing.T) {
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	defer func() { interfaceAddrs = net.InterfaceAddrs }()
+
+	resolver := &fakeResolver{hosts: []string{"10.0.0.1", "10.0.0.2"}}
+	self, err := SelfAddr(DNSConfig{Name: "mycache.default.svc", Port: 8001, Resolver: resolver})
+	if err != nil || self != "http://10.0.0.2:8001" {
+		t.Fatalf("self should be the local record, got %q, %v", self, err)
+	}
+
+	// SRV记录中的主机名解析到本机
+	resolver = &fakeResolver{hosts: []string{"10.0.0.2"}, srvs: []*net.SRV{{Target: "mycache-1.mycache.default.svc.", Port: 8002}}}
+	self, err = SelfAddr(DNSConfig{Name: "_mycache._tcp.mycache.default.svc", SRV: true, Resolver: resolver})
+	if err != nil || self != "http://mycache-1.mycache.default.svc:8002" {
+		t.Fatalf("self should be the local SRV target, got %q, %v", self, err)
+	}
+
+	resolver = &fakeResolver{hosts: []string{"10.0.0.1"}}
+	if _, err := SelfAddr(DNSConfig{Name: "mycache.default.svc", Port: 8001, Resolver: resolver}); err == nil {
+		t.Error("records without a local address should be reported")
+	}
+}
@@ -0,0 +1,202 @@
+package discovery
+
+// 定期解析域名 适合部署在headless service之后
+// A/AAAA记录：每个IP加上配置的端口组成一个节点
+// SRV记录：使用记录中的主机名和端口 SRV的权重用于负载均衡而不是数据分布，这里忽略
+// 解析失败或没有任何记录时保留之前的节点列表，避免DNS抖动清空整个集群
+// 自己的地址必须与记录中的地址一致，否则环上会多出一个并不存在的节点，可以用 SelfAddr 从记录中找出
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDNSInterval = 30 * time.Second
+	defaultDNSTimeout  = 5 * time.Second
+)
+
+// 与 *net.Resolver 的方法一致 测试时可以替换
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+type DNSConfig struct {
+	Name     string        // 要解析的域名 SRV模式下为完整的记录名 例如 _mycache._tcp.mycache.default.svc
+	SRV      bool          // 解析SRV记录 否则解析A/AAAA记录
+	Port     int           // A记录模式下节点的端口
+	Scheme   string        // 节点地址的scheme 默认为http
+	Interval time.Duration // 刷新间隔 默认30s
+	Timeout  time.Duration // 单次解析的超时 默认5s
+	Resolver Resolver      // 默认为 net.DefaultResolver
+}
+
+type DNSWatcher struct {
+	conf    DNSConfig
+	applier *applier
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// 本机网卡的地址 测试时可以替换
+var interfaceAddrs = net.InterfaceAddrs
+
+func (conf *DNSConfig) setDefaults() error {
+	if conf.Name == "" {
+		return errors.New("discovery: DNS name is required")
+	}
+	if !conf.SRV && conf.Port == 0 {
+		return errors.New("discovery: port is required for A records")
+	}
+	if conf.Scheme == "" {
+		conf.Scheme = "http"
+	}
+	if conf.Interval == 0 {
+		conf.Interval = defaultDNSInterval
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultDNSTimeout
+	}
+	if conf.Resolver == nil {
+		conf.Resolver = net.DefaultResolver
+	}
+	return nil
+}
+
+// 解析一次并开始定期刷新 首次解析失败时返回错误
+func WatchDNS(conf DNSConfig, peers PeerSetter) (*DNSWatcher, error) {
+	if err := conf.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	w := &DNSWatcher{
+		conf:    conf,
+		applier: &applier{name: conf.Name, setter: peers},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := w.Refresh(); err != nil {
+		return nil, err
+	}
+
+	go w.loop()
+	return w, nil
+}
+
+// 重新解析并应用变化
+func (w *DNSWatcher) Refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.conf.Timeout)
+	defer cancel()
+
+	peers, err := w.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return errors.New("discovery: no records for " + w.conf.Name)
+	}
+	w.applier.apply(peers)
+	return nil
+}
+
+func (w *DNSWatcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *DNSWatcher) loop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Refresh(); err != nil {
+				log.Printf("[Discovery %s] keeping previous peers: %v", w.conf.Name, err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *DNSWatcher) resolve(ctx context.Context) ([]Peer, error) {
+	var peers []Peer
+	if w.conf.SRV {
+		_, records, err := w.conf.Resolver.LookupSRV(ctx, "", "", w.conf.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			peers = append(peers, Peer{Addr: w.peerAddr(host, int(srv.Port))})
+		}
+		return peers, nil
+	}
+
+	hosts, err := w.conf.Resolver.LookupHost(ctx, w.conf.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		peers = append(peers, Peer{Addr: w.peerAddr(host, w.conf.Port)})
+	}
+	return peers, nil
+}
+
+// 记录中属于本机的地址 与其他节点解析出的地址相同
+// A记录中是本机网卡的IP SRV记录中主机名解析到本机网卡的IP
+func SelfAddr(conf DNSConfig) (string, error) {
+	if err := conf.setDefaults(); err != nil {
+		return "", err
+	}
+	local := make(map[string]bool)
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			local[ipnet.IP.String()] = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout)
+	defer cancel()
+	w := &DNSWatcher{conf: conf}
+	peers, err := w.resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range peers {
+		u, err := url.Parse(p.Addr)
+		if err != nil {
+			continue
+		}
+		ips := []string{u.Hostname()}
+		if net.ParseIP(u.Hostname()) == nil {
+			if ips, err = conf.Resolver.LookupHost(ctx, u.Hostname()); err != nil {
+				continue
+			}
+		}
+		for _, ip := range ips {
+			if parsed := net.ParseIP(ip); parsed != nil && local[parsed.String()] {
+				return p.Addr, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("discovery: none of the records of %s is a local address", conf.Name)
+}
+
+func (w *DNSWatcher) peerAddr(host string, port int) string {
+	return w.conf.Scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
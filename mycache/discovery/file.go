@@ -0,0 +1,131 @@
+package discovery
+
+// 从JSON文件读取节点列表 格式与部署工具生成的文件一致：
+// {"peers": [{"addr": "http://10.0.0.1:8001", "weight": 2}, {"addr": "http://10.0.0.2:8001"}]}
+// 定期检查文件的修改时间和大小，或者收到SIGHUP时重新读取
+// 文件格式错误时保留之前的节点列表
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultFileInterval = 5 * time.Second
+
+type peersFile struct {
+	Peers []Peer `json:"peers"`
+}
+
+type FileWatcher struct {
+	path     string
+	interval time.Duration
+	applier  *applier
+	mu       sync.Mutex // 保护modTime和size
+	modTime  time.Time
+	size     int64
+	sighup   chan os.Signal
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// 读取一次文件并开始监听 首次读取失败时返回错误
+// interval为0时每5秒检查一次 小于0时只响应SIGHUP
+func WatchFile(path string, peers PeerSetter, interval time.Duration) (*FileWatcher, error) {
+	if interval == 0 {
+		interval = defaultFileInterval
+	}
+	w := &FileWatcher{
+		path:     path,
+		interval: interval,
+		applier:  &applier{name: path, setter: peers},
+		sighup:   make(chan os.Signal, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+
+	signal.Notify(w.sighup, syscall.SIGHUP)
+	go w.loop()
+	return w, nil
+}
+
+// 重新读取文件并应用变化
+func (w *FileWatcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	var f peersFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parsing %s: %v", w.path, err)
+	}
+	// 与DNS一样 空的列表多半是文件写了一半或者写错了 保留之前的节点
+	if len(f.Peers) == 0 {
+		return fmt.Errorf("parsing %s: no peers", w.path)
+	}
+	for _, p := range f.Peers {
+		if p.Addr == "" {
+			return fmt.Errorf("parsing %s: peer without addr", w.path)
+		}
+	}
+
+	w.modTime, w.size = info.ModTime(), info.Size()
+	w.applier.apply(f.Peers)
+	return nil
+}
+
+func (w *FileWatcher) Stop() {
+	signal.Stop(w.sighup)
+	close(w.stop)
+	<-w.done
+}
+
+func (w *FileWatcher) loop() {
+	defer close(w.done)
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			if !w.changed() {
+				continue
+			}
+		case <-w.sighup:
+		case <-w.stop:
+			return
+		}
+		if err := w.Reload(); err != nil {
+			log.Printf("[Discovery %s] keeping previous peers: %v", w.path, err)
+		}
+	}
+}
+
+// 修改时间或大小变化说明文件被重写了
+func (w *FileWatcher) changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info, err := os.Stat(w.path)
+	return err == nil && (!info.ModTime().Equal(w.modTime) || info.Size() != w.size)
+}
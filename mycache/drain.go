@@ -0,0 +1,257 @@
+package mycache
+
+// 节点下线时把缓存迁移给新的owner
+// 1. 从节点列表中移除自己，并通知集群（LeaveCluster），之后的请求不再路由到本节点
+// 2. 按新的环计算本地每个key的owner
+// 3. 按owner分批把条目发送过去，最热的条目最先发送
+// 进度可以通过 <basePath>_admin/drain 查看，POST该路径开始迁移
+// POST会让节点下线 只有配置了认证(SharedSecret或mTLS)时才接受
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	pb "mycache/mycachepb"
+	"net/http"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	handoffPath = "_handoff"
+	adminPath   = "_admin/"
+
+	// 每批迁移的条目数和字节数 一批的大小不超过 MaxRequestBytes
+	handoffBatchSize  = 100
+	handoffBatchBytes = 4 << 20
+
+	defaultMaxRequestBytes = 64 << 20
+)
+
+type DrainState string
+
+const (
+	DrainIdle    DrainState = "idle"
+	DrainRunning DrainState = "draining"
+	DrainDone    DrainState = "done"
+	DrainFailed  DrainState = "failed"
+)
+
+// 下线迁移的进度
+type DrainStatus struct {
+	State      DrainState `json:"state"`
+	Keys       int64      `json:"keys"`    // 需要迁移的条目数
+	Sent       int64      `json:"sent"`    // 已经迁移的条目数
+	Failed     int64      `json:"failed"`  // 迁移失败的条目数
+	Batches    int64      `json:"batches"` // 已经发送的批次
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// 当前的迁移进度
+func (hp *HTTPPool) DrainStatus() DrainStatus {
+	hp.drainMu.Lock()
+	defer hp.drainMu.Unlock()
+
+	status := hp.drain
+	if status.State == "" {
+		status.State = DrainIdle
+	}
+	return status
+}
+
+// 下线迁移 阻塞直到所有条目发送完毕
+// 完成之后调用 OnDrained
+func (hp *HTTPPool) Drain() error {
+	hp.drainMu.Lock()
+	if hp.drain.State == DrainRunning {
+		hp.drainMu.Unlock()
+		return errors.New("drain already in progress")
+	}
+	hp.drain = DrainStatus{State: DrainRunning, StartedAt: time.Now()}
+	hp.drainMu.Unlock()
+
+	hp.Log("Draining")
+	err := hp.handoff()
+
+	hp.drainMu.Lock()
+	hp.drain.FinishedAt = time.Now()
+	hp.drain.State = DrainDone
+	if err != nil {
+		hp.drain.State = DrainFailed
+		hp.drain.Error = err.Error()
+	}
+	status := hp.drain
+	hp.drainMu.Unlock()
+
+	hp.Log("Drain %s: sent %d of %d entries, %d failed", status.State, status.Sent, status.Keys, status.Failed)
+	if hp.opts.OnDrained != nil {
+		hp.opts.OnDrained()
+	}
+	return err
+}
+
+func (hp *HTTPPool) handoff() error {
+	// 从环中移除自己
+	hp.mu.Lock()
+	var peers []string
+	for _, peer := range hp.peers {
+		if peer != hp.self {
+			peers = append(peers, peer)
+		}
+	}
+	weights := hp.weights
+	hp.mu.Unlock()
+
+	if len(peers) == 0 {
+		return errors.New("no other peers to hand off to")
+	}
+	hp.setPeers(peers, weights)
+	if hp.opts.LeaveCluster != nil {
+		if err := hp.opts.LeaveCluster(); err != nil {
+			hp.Log("Failed to leave cluster: %v", err)
+		}
+	}
+
+	// 按新的owner分组 环在SetPeers时整体替换 取出之后不需要持有锁
+	hp.mu.Lock()
+	ring, getters := hp.chash, hp.httpGetters
+	hp.mu.Unlock()
+	batches := make(map[string][]*pb.Entry)
+	for _, g := range allGroups() {
+		keys, values := g.mcache.entries()
+		for i, key := range keys {
+			owner := ring.Get(key)
+			batches[owner] = append(batches[owner], &pb.Entry{Group: g.name, Key: key, Value: values[i].bytes})
+		}
+	}
+
+	var total int64
+	for _, entries := range batches {
+		total += int64(len(entries))
+	}
+	hp.updateDrain(func(s *DrainStatus) { s.Keys = total })
+
+	var lastErr error
+	for owner, entries := range batches {
+		for len(entries) > 0 {
+			batch := entries[:batchLen(entries)]
+			entries = entries[len(batch):]
+			n := int64(len(batch))
+
+			err := getters[owner].putBatch(&pb.Batch{Entries: batch})
+			if err != nil {
+				lastErr = fmt.Errorf("handoff to %s: %v", owner, err)
+				hp.Log("%v", lastErr)
+				hp.updateDrain(func(s *DrainStatus) { s.Failed += n })
+				continue
+			}
+			hp.Stats.HandoffSent.Add(n)
+			hp.updateDrain(func(s *DrainStatus) {
+				s.Sent += n
+				s.Batches++
+			})
+		}
+	}
+	return lastErr
+}
+
+// 下一批的条目数 不超过handoffBatchSize个和handoffBatchBytes字节 至少一个
+func batchLen(entries []*pb.Entry) int {
+	size := 0
+	for i, e := range entries {
+		size += len(e.Key) + len(e.Value)
+		if i == handoffBatchSize || i > 0 && size > handoffBatchBytes {
+			return i
+		}
+	}
+	return len(entries)
+}
+
+func (hp *HTTPPool) updateDrain(fn func(s *DrainStatus)) {
+	hp.drainMu.Lock()
+	defer hp.drainMu.Unlock()
+	fn(&hp.drain)
+}
+
+// 接收其他节点迁移过来的条目
+func (hp *HTTPPool) serveHandoff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch := &pb.Batch{}
+	if err := proto.Unmarshal(body, batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, e := range batch.Entries {
+		if g := GetGroup(e.Group); g != nil {
+			g.populateCache(e.Key, ByteView{bytes: e.Value})
+			hp.Stats.HandoffReceived.Add(1)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 管理接口
+// GET  <basePath>_admin/drain 查看迁移进度
+// POST <basePath>_admin/drain 开始下线迁移 没有配置认证时返回403
+// GET  <basePath>_admin/ready 预热完成返回200 否则返回503
+func (hp *HTTPPool) serveAdmin(w http.ResponseWriter, r *http.Request, action string) {
+	switch action {
+	case "drain":
+	case "ready":
+		hp.serveReady(w, r)
+		return
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+	case http.MethodPost:
+		if !hp.authRequired() {
+			http.Error(w, "Forbidden: draining needs SharedSecret or mTLS", http.StatusForbidden)
+			return
+		}
+		if hp.DrainStatus().State != DrainRunning {
+			go hp.Drain()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hp.DrainStatus())
+}
+
+// 向对应节点发送一批条目
+func (hg *httpGetter) putBatch(batch *pb.Batch) error {
+	body, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	res, err := hg.post(handoffPath, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package mycache
+
+// 错误的语义
+// 节点之间只传递状态码和错误信息 调用方无法区分"key不存在"和"数据库宕机"
+// 服务端把错误映射为 pb.Status 随 pb.Response 返回 客户端再还原成下面的哨兵错误
+// 调用方用 errors.Is 判断 本地和远程返回的错误判断方式相同
+
+import (
+	"errors"
+	pb "mycache/mycachepb"
+	"net/http"
+)
+
+var (
+	// 数据源中没有这个key Getter应当返回包装了它的错误
+	// 例如 fmt.Errorf("%s: %w", key, mycache.ErrNotFound)
+	ErrNotFound = errors.New("mycache: key not found")
+	// 节点上没有这个group
+	ErrGroupNotFound = errors.New("mycache: group not found")
+	// 数据源暂时不可用 可以稍后重试 Getter同样可以包装它
+	ErrUnavailable = errors.New("mycache: unavailable")
+)
+
+// 远程节点返回的错误 Unwrap得到对应的哨兵错误
+type peerError struct {
+	status  pb.Status
+	message string
+}
+
+func (e *peerError) Error() string {
+	return e.message
+}
+
+func (e *peerError) Unwrap() error {
+	switch e.status {
+	case pb.Status_NOT_FOUND:
+		return ErrNotFound
+	case pb.Status_GROUP_NOT_FOUND:
+		return ErrGroupNotFound
+	case pb.Status_UNAVAILABLE:
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// 错误对应的状态码
+func statusOf(err error) pb.Status {
+	switch {
+	case err == nil:
+		return pb.Status_OK
+	case errors.Is(err, ErrNotFound):
+		return pb.Status_NOT_FOUND
+	case errors.Is(err, ErrGroupNotFound):
+		return pb.Status_GROUP_NOT_FOUND
+	case errors.Is(err, ErrUnavailable):
+		return pb.Status_UNAVAILABLE
+	}
+	return pb.Status_INTERNAL
+}
+
+// 带错误状态的响应
+func errorResponse(err error) *pb.Response {
+	return &pb.Response{Status: statusOf(err), Message: err.Error()}
+}
+
+// 从响应中还原错误 状态为OK时返回nil
+func responseError(res *pb.Response) error {
+	if res.GetStatus() == pb.Status_OK {
+		return nil
+	}
+	return &peerError{status: res.Status, message: res.Message}
+}
+
+// 状态码对应的http状态码 让不认识pb.Status的客户端也能区分
+func httpStatus(status pb.Status) int {
+	switch status {
+	case pb.Status_OK:
+		return http.StatusOK
+	case pb.Status_NOT_FOUND, pb.Status_GROUP_NOT_FOUND:
+		return http.StatusNotFound
+	case pb.Status_UNAVAILABLE:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
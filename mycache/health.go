@@ -0,0 +1,230 @@
+package mycache
+
+// 节点健康检查和熔断
+// 每个peer有一个熔断器：连续失败达到阈值之后打开 打开期间PickPeer跳过该节点 改为选择环上的下一个节点
+// 打开一段时间之后进入半开状态 放行一个请求试探 成功则关闭 失败则重新打开
+// 主动健康检查定期请求每个peer的 /healthz 结果同样计入熔断器
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthPath = "/healthz"
+
+	defaultFailureThreshold   = 5
+	defaultBreakerOpenTimeout = 5 * time.Second
+	defaultHealthCheckTimeout = time.Second
+)
+
+var errBreakerOpen = errors.New("peer circuit breaker is open")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+type breaker struct {
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int // 连续失败次数
+	openedAt  time.Time
+	trial     bool // 半开状态下是否已经放行了试探请求
+	threshold int
+	timeout   time.Duration
+	stats     *PoolStats
+}
+
+func newBreaker(threshold int, timeout time.Duration, stats *PoolStats) *breaker {
+	return &breaker{state: BreakerClosed, threshold: threshold, timeout: timeout, stats: stats}
+}
+
+// 是否可以选择该节点 只做检查 不占用半开状态下的试探机会
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.timeout
+	case BreakerHalfOpen:
+		return !b.trial
+	}
+	return true
+}
+
+// 真正发送请求之前调用 半开状态下只放行一个试探请求
+// trial表示这个请求是试探请求 它的结果必须通过success/failure/release报告
+func (b *breaker) acquire() (ok, trial bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return false, false
+		}
+		b.state, b.trial = BreakerHalfOpen, true
+		return true, true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false, false
+		}
+		b.trial = true
+		return true, true
+	}
+	return true, false
+}
+
+// 试探请求被取消 没有结果 让下一个请求重新试探
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.trial = false
+	}
+}
+
+// 熔断打开 还没有到放行试探请求的时间
+func (b *breaker) blocked() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == BreakerOpen && time.Since(b.openedAt) < b.timeout
+}
+
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state, b.failures, b.trial = BreakerClosed, 0, false
+}
+
+func (b *breaker) failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.state, b.openedAt, b.trial = BreakerOpen, time.Now(), false
+		b.stats.BreakerOpens.Add(1)
+	}
+}
+
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// 每个peer熔断器的状态
+func (hp *HTTPPool) PeerHealth() map[string]BreakerState {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	health := make(map[string]BreakerState, len(hp.breakers))
+	for peer, b := range hp.breakers {
+		health[peer] = b.State()
+	}
+	return health
+}
+
+// peer的熔断器 节点列表变化时保留 调用时需持有hp.mu
+func (hp *HTTPPool) breakerLocked(peer string) *breaker {
+	if hp.breakers == nil {
+		hp.breakers = make(map[string]*breaker)
+	}
+	b, ok := hp.breakers[peer]
+	if !ok {
+		b = newBreaker(hp.opts.FailureThreshold, hp.opts.BreakerOpenTimeout, &hp.Stats)
+		hp.breakers[peer] = b
+	}
+	return b
+}
+
+// key的候选节点 按优先级排列 第一个就是owner 调用时需持有hp.mu
+func (hp *HTTPPool) successorsLocked(key string) []string {
+	if sp, ok := hp.chash.(successorPlacement); ok {
+		return sp.GetN(key, len(hp.peers))
+	}
+
+	// 不支持GetN的放置策略 owner仍由它决定 后继按setPeers中建好的哈希环排列
+	owner := hp.chash.Get(key)
+	if owner == "" {
+		return nil
+	}
+	nodes := []string{owner}
+	for _, node := range hp.successors.GetN(key, len(hp.peers)) {
+		if node != owner {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// 主动健康检查 定期请求每个peer的 /healthz
+func (hp *HTTPPool) healthLoop() {
+	// 与请求共用连接池 超时单独设置
+	client := &http.Client{Transport: hp.client.Transport, Timeout: hp.opts.HealthCheckTimeout}
+	ticker := time.NewTicker(hp.opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hp.mu.Lock()
+		peers := append([]string(nil), hp.peers...)
+		hp.mu.Unlock()
+
+		for _, peer := range peers {
+			if peer == hp.self {
+				continue
+			}
+			hp.mu.Lock()
+			b := hp.breakerLocked(peer)
+			hp.mu.Unlock()
+
+			res, err := client.Get(peerURL(peer) + healthPath)
+			if err != nil {
+				b.failure()
+				continue
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				b.failure()
+				continue
+			}
+			b.success()
+		}
+	}
+}
+
+// GET /healthz 下线迁移期间返回503
+func (hp *HTTPPool) serveHealth(w http.ResponseWriter) {
+	if hp.DrainStatus().State == DrainRunning {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
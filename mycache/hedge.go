@@ -0,0 +1,105 @@
+package mycache
+
+// 对冲请求
+// 个别节点偶尔的GC停顿会拖慢整体的尾延迟
+// 向owner的请求超过最近请求耗时的p95还没有返回时 向环上owner之后的下一个节点再发一个请求 先返回的生效
+// 它是owner不可用时接手这个key的节点(TryNext和熔断改道也会选它) 对冲请求按普通请求处理 未命中时由它回源并缓存
+// 对冲请求数不超过总请求数的 HedgeBudget 避免节点整体变慢时请求数和回源数翻倍
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindowSize = 1024 // 保留最近多少次请求的耗时
+	latencyMinSamples = 20   // 样本太少时不对冲
+	latencyRecompute  = 64   // 每新增多少个样本重新计算一次p95
+)
+
+// 最近请求耗时的滑动窗口
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int // 环形缓冲区中下一个写入的位置
+	added   int // 上次计算之后新增的样本数
+	p95     time.Duration
+}
+
+func (l *latencyWindow) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < latencyWindowSize {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.next] = d
+	}
+	l.next = (l.next + 1) % latencyWindowSize
+
+	l.added++
+	if l.added >= latencyRecompute || (l.p95 == 0 && len(l.samples) >= latencyMinSamples) {
+		l.added = 0
+		sorted := append([]time.Duration(nil), l.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		l.p95 = sorted[len(sorted)*95/100]
+	}
+}
+
+// 样本不足时返回0
+func (l *latencyWindow) quantile() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < latencyMinSamples {
+		return 0
+	}
+	return l.p95
+}
+
+// 向peer请求耗时的p95
+func (hp *HTTPPool) PeerLatencyP95() time.Duration {
+	return hp.latency.quantile()
+}
+
+// 环上owner之后第一个可用的其他节点 即owner的后继 等待时间为观测到的p95
+func (hp *HTTPPool) PickHedge(key string, primary PeerGetter) (PeerGetter, time.Duration, bool) {
+	if hp.opts.HedgeBudget <= 0 {
+		return nil, 0, false
+	}
+	hp.peerFetches.Add(1)
+	delay := hp.latency.quantile()
+	if delay == 0 {
+		return nil, 0, false
+	}
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if hp.chash == nil {
+		return nil, 0, false
+	}
+	for _, node := range hp.successorsLocked(key) {
+		getter, ok := hp.httpGetters[node]
+		if node == hp.self || !ok || getter == primary {
+			continue
+		}
+		if getter.breaker != nil && getter.breaker.State() != BreakerClosed {
+			continue
+		}
+		return getter, delay, true
+	}
+	return nil, 0, false
+}
+
+// 对冲请求数不超过总请求数的HedgeBudget
+func (hp *HTTPPool) AllowHedge() bool {
+	if float64(hp.hedgesIssued.Load()+1) > hp.opts.HedgeBudget*float64(hp.peerFetches.Load()) {
+		hp.Stats.HedgesOverBudget.Add(1)
+		return false
+	}
+	hp.hedgesIssued.Add(1)
+	hp.Stats.Hedges.Add(1)
+	return true
+}
@@ -0,0 +1,238 @@
+package mycache
+
+// hinted handoff
+// 写入或删除发给key的owner 如果owner暂时不可达 就发给环上的后继节点
+// 后继节点把它作为hint暂存 定期尝试重放给owner 成功之后删除 后继也不可用时在本地暂存
+// hint按写入顺序保存 同一个key只保留最后一次 总大小和保存时间都有上限
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	pb "mycache/mycachepb"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	writePath = "_write"
+
+	defaultHintMaxBytes       = 1 << 20
+	defaultHintMaxAge         = 10 * time.Minute
+	defaultHintReplayInterval = time.Second
+)
+
+// 一条暂存的写入
+type hint struct {
+	owner string
+	req   *pb.WriteRequest // HintFor已经清空 可以直接发给owner
+	size  int64
+	at    time.Time
+}
+
+// 当前暂存的hint数量和大小
+func (hp *HTTPPool) Hints() (count int, size int64) {
+	hp.hintMu.Lock()
+	defer hp.hintMu.Unlock()
+	return len(hp.hints), hp.hintBytes
+}
+
+// 写入key的owner 不可达时把hint交给后继节点
+// owner已经熔断时不再尝试 直接交给后继节点
+func (hg *httpGetter) Write(in *pb.WriteRequest) error {
+	if hg.breaker.blocked() {
+		hg.pool.Log("Owner %s is unhealthy, handing off a hint", hg.peer)
+		return hg.pool.handoffHint(hg.peer, in)
+	}
+	err := hg.postWrite(in)
+	var ue *url.Error
+	if err == nil || !errors.As(err, &ue) {
+		return err
+	}
+
+	hg.pool.Log("Owner %s unreachable, handing off a hint: %v", hg.peer, err)
+	return hg.pool.handoffHint(hg.peer, in)
+}
+
+func (hg *httpGetter) postWrite(in *pb.WriteRequest) error {
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+	res, err := hg.post(writePath, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
+
+// 把写入作为hint交给owner在环上的后继节点 后继是自己时直接暂存
+// 后继也熔断或者不可达时 才在本地暂存
+func (hp *HTTPPool) handoffHint(owner string, in *pb.WriteRequest) error {
+	next, getter := hp.successor(owner, in.Key)
+	if next == "" {
+		return fmt.Errorf("no successor for unreachable owner %s", owner)
+	}
+
+	req := proto.Clone(in).(*pb.WriteRequest)
+	req.HintFor = owner
+	if next == hp.self {
+		hp.storeHint(req)
+		return nil
+	}
+	if getter.breaker.blocked() {
+		hp.Log("Successor %s is unhealthy, storing the hint locally", next)
+		hp.storeHint(req)
+		return nil
+	}
+	err := getter.postWrite(req)
+	var ue *url.Error
+	if err == nil || !errors.As(err, &ue) {
+		return err
+	}
+	hp.Log("Successor %s unreachable, storing the hint locally: %v", next, err)
+	hp.storeHint(req)
+	return nil
+}
+
+// owner之后环上的下一个节点 以及发给它的getter 不在节点列表中时使用临时的getter
+func (hp *HTTPPool) successor(owner, key string) (string, *httpGetter) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if hp.chash == nil {
+		return "", nil
+	}
+	for _, node := range hp.successorsLocked(key) {
+		if node == owner {
+			continue
+		}
+		if getter, ok := hp.httpGetters[node]; ok {
+			return node, getter
+		}
+		return node, hp.newGetter(node)
+	}
+	return "", nil
+}
+
+// 暂存一条hint 同一个owner的同一个key只保留最后一次写入
+func (hp *HTTPPool) storeHint(req *pb.WriteRequest) {
+	h := &hint{owner: req.HintFor, req: proto.Clone(req).(*pb.WriteRequest), at: time.Now()}
+	h.req.HintFor = ""
+	h.size = int64(len(req.Group) + len(req.Key) + len(req.Value))
+
+	hp.hintMu.Lock()
+	hp.addHintLocked(h)
+	hp.hintMu.Unlock()
+	hp.Stats.HintsStored.Add(1)
+
+	hp.hintOnce.Do(func() { go hp.replayLoop() })
+}
+
+func (hp *HTTPPool) addHintLocked(h *hint) {
+	for i, old := range hp.hints {
+		if old.owner == h.owner && old.req.Group == h.req.Group && old.req.Key == h.req.Key {
+			hp.hints = append(hp.hints[:i], hp.hints[i+1:]...)
+			hp.hintBytes -= old.size
+			break
+		}
+	}
+	hp.hints = append(hp.hints, h)
+	hp.hintBytes += h.size
+
+	// 超出上限时丢弃最早的hint
+	for hp.hintBytes > hp.opts.HintMaxBytes && len(hp.hints) > 0 {
+		hp.hintBytes -= hp.hints[0].size
+		hp.hints = hp.hints[1:]
+		hp.Stats.HintsDropped.Add(1)
+	}
+}
+
+func (hp *HTTPPool) replayLoop() {
+	ticker := time.NewTicker(hp.opts.HintReplayInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		hp.replayHints()
+	}
+}
+
+// 按顺序向owner重放hint 某个owner失败之后 它剩下的hint留到下一次
+func (hp *HTTPPool) replayHints() {
+	hp.hintMu.Lock()
+	pending := hp.hints
+	hp.hints, hp.hintBytes = nil, 0
+	hp.hintMu.Unlock()
+
+	var keep []*hint
+	down := make(map[string]bool)
+	for _, h := range pending {
+		if time.Since(h.at) > hp.opts.HintMaxAge {
+			hp.Stats.HintsDropped.Add(1)
+			continue
+		}
+		if down[h.owner] {
+			keep = append(keep, h)
+			continue
+		}
+		getter := hp.newGetter(h.owner)
+		if err := getter.postWrite(h.req); err != nil {
+			down[h.owner] = true
+			keep = append(keep, h)
+			continue
+		}
+		hp.Stats.HintsReplayed.Add(1)
+	}
+	if len(pending) > len(keep) {
+		hp.Log("Replayed %d hints, %d pending", len(pending)-len(keep), len(keep))
+	}
+
+	// 重放期间收到的hint更新 放在后面
+	hp.hintMu.Lock()
+	defer hp.hintMu.Unlock()
+	added := hp.hints
+	hp.hints, hp.hintBytes = nil, 0
+	for _, h := range append(keep, added...) {
+		hp.addHintLocked(h)
+	}
+}
+
+// POST <basePath>_write 写入或删除 hint_for不为空时暂存为hint
+func (hp *HTTPPool) serveWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &pb.WriteRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.HintFor != "" && req.HintFor != hp.self {
+		hp.storeHint(req)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	group := GetGroup(req.Group)
+	if group == nil {
+		http.Error(w, "No such Group: "+req.Group, http.StatusNotFound)
+		return
+	}
+	// 与Get一样只在本地处理 不再转发
+	group.applyWrite(req)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,15 +3,23 @@ package mycache
 // 提供被其他节点访问的能力(基于http)
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"mycache/consistenthash"
 	pb "mycache/mycachepb"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 )
@@ -19,26 +27,274 @@ import (
 const (
 	defaultBasePath = "/_mycache/"
 	defaultReplicas = 50
+
+	// 请求方使用的放置算法 与自己不一致的请求会被拒绝
+	algorithmHeader = "X-Mycache-Algorithm"
+	// 哈希环的版本 请求中携带发送方的版本 响应中携带接收方的版本
+	ringVersionHeader = "X-Mycache-Ring-Version"
+	// 转发请求的节点
+	forwardedByHeader  = "X-Mycache-Forwarded-By"
+	peekHeader         = "X-Mycache-Peek"
+	acceptStreamHeader = "X-Mycache-Accept-Stream"
+	streamHeader       = "X-Mycache-Stream"
+
+	// 严格模式下 发现环版本不一致之后暂停向该peer转发的时间
+	ringMismatchBackoff = time.Second
 )
 
 type HTTPPool struct {
 	self        string // 自己的地址 IP+port
 	basePath    string
-	mu          sync.Mutex                     // 假设有多个client向你发送请求
-	chash       *consistenthash.ConsistentHash // 选择对应的节点
-	httpGetters map[string]*httpGetter         // 远程节点和Get方法映射
+	opts        HTTPPoolOptions
+	mu          sync.Mutex               // 假设有多个client向你发送请求
+	chash       consistenthash.Placement // 选择对应的节点
+	algorithm   string                   // 放置算法的版本
+	ringVersion string                   // 哈希环的版本 节点列表和算法的hash
+	httpGetters map[string]*httpGetter   // 远程节点和Get方法映射
+	peers       []string                 // 当前的节点列表
+	weights     map[string]int           // 节点权重 没有设置时为nil
+
+	drainMu sync.Mutex
+	drain   DrainStatus // 下线迁移的进度
+
+	warmMu sync.Mutex
+	warm   WarmupStatus // 加入集群时预热的进度
+
+	ranges rangeSnapshots // 其他节点预热时正在拉取的快照
+
+	successors *consistenthash.ConsistentHash // 放置策略不支持GetN时用于排列后继节点
+
+	prevChash   consistenthash.Placement // 过渡期内保留的旧的环
+	prevUntil   time.Time
+	prevGetters map[string]*httpGetter // 旧的环上已经移除的节点 保留它们的熔断器
+
+	hintMu    sync.Mutex
+	hints     []*hint // 替不可用的owner暂存的写入 按写入顺序
+	hintBytes int64
+	hintOnce  sync.Once // 第一次收到hint时启动重放
+
+	breakers   map[string]*breaker // 每个peer的熔断器 节点列表变化时保留
+	healthOnce sync.Once
+
+	client    *http.Client              // 所有peer共用的client
+	connStats map[string]*PeerConnStats // 每个peer的连接统计 节点列表变化时保留
+	serverTLS *tls.Config               // 没有配置TLS时为nil
+	clientTLS *tls.Config
+
+	latency      latencyWindow // 最近向peer请求的耗时 用于计算对冲的等待时间
+	peerFetches  atomic.Int64  // 可以对冲的请求数
+	hedgesIssued atomic.Int64
+
+	lastMismatch atomic.Value // 最近一次记录日志的环版本组合 "本地 远端"
+
+	Stats PoolStats
+}
+
+// HTTPPool的可选配置
+type HTTPPoolOptions struct {
+	// 节点间通信的路径前缀 默认为 "/_mycache/"
+	BasePath string
+
+	// 每个真实节点的虚拟节点数 默认为50
+	Replicas int
+
+	// 一致性哈希使用的hash函数 默认为crc32
+	HashFn consistenthash.Hash
+
+	// 内置的hash算法 consistenthash.CRC32 / FNV1a64 / CRC64
+	// 设置了HashFn时忽略
+	HashAlgorithm string
+
+	// 有界负载系数ε 大于0时启用有界负载的一致性哈希
+	// 每个节点的容量为 (1+ε)×平均在途请求数 超过容量时顺时针选择下一个节点
+	// 只对哈希环（ConsistentHash）生效
+	LoadFactor float64
+
+	// 节点放置策略 每次SetPeers时调用以创建新的实例
+	// 为nil时使用 Replicas 和 HashFn/HashAlgorithm 创建哈希环
+	NewPlacement func() consistenthash.Placement
+
+	// 环版本不一致时拒绝转发 直到双方的节点列表收敛
+	// 默认只记录日志和统计 请求照常处理
+	RefuseOnRingMismatch bool
+
+	// 下线迁移时把自己从集群成员中移除 例如 membership.Memberlist.Leave
+	LeaveCluster func() error
+
+	// 下线迁移完成之后调用 通常在这里退出进程
+	OnDrained func()
+
+	// 加入集群时先从之前的owner拉取属于自己的条目 完成之后才算就绪
+	WarmJoin bool
+
+	// 预热时拉取数据的速度上限 字节/秒 0表示不限制
+	WarmupRate int64
+
+	// 节点列表变化之后 旧的环保留的时间 0表示不保留
+	// 过渡期内新owner未命中时先向旧owner查询缓存 再回源
+	TransitionWindow time.Duration
+
+	// 替不可用的owner暂存hint的上限 超过之后丢弃最早的hint 默认1MB
+	HintMaxBytes int64
+	// hint的最长保存时间 过期的hint不再重放 默认10分钟
+	HintMaxAge time.Duration
+	// 尝试向owner重放hint的间隔 默认1秒
+	HintReplayInterval time.Duration
+
+	// 主动健康检查的间隔 0表示不检查 只根据请求结果熔断
+	HealthCheckInterval time.Duration
+	// 健康检查的超时时间 默认1秒
+	HealthCheckTimeout time.Duration
+	// 连续失败多少次之后熔断 默认5次
+	FailureThreshold int
+	// 熔断之后多久进入半开状态 放行一个请求试探 默认5秒
+	BreakerOpenTimeout time.Duration
+
+	// 对冲请求最多占请求总数的比例 例如0.05 0表示不对冲
+	// primary超过最近请求耗时的p95还没有返回时 向环上的下一个节点再发一个请求
+	HedgeBudget float64
+
+	// 向peer发送请求使用的client 为nil时按下面的参数创建
+	// 自定义的client不支持unix://的peer
+	Client *http.Client
+	// 单次请求的超时 包括读取响应 默认5秒
+	RequestTimeout time.Duration
+	// 建立连接的超时 默认2秒
+	DialTimeout time.Duration
+	// TCP keep-alive的间隔 默认30秒
+	KeepAlive time.Duration
+	// 每个peer保留的空闲连接数 默认64
+	MaxIdleConnsPerHost int
+	// 空闲连接保留的时间 默认90秒
+	IdleConnTimeout time.Duration
+
+	// 超过这个大小的值直接以原始数据返回 不做protobuf编码 默认1MB
+	StreamThreshold int64
+
+	// 超过这个大小的响应按对方支持的方式压缩(gzip/deflate) 默认1KB 负数表示不压缩
+	CompressThreshold int
+
+	// 请求体的上限 超过时返回413 默认64MB
+	// 最大的请求是一次写入或者一批迁移的条目 值比这个还大时无法写入和迁移
+	MaxRequestBytes int64
+
+	// 节点间使用TLS 为nil时使用明文http
+	TLS *TLSOptions
+	// 节点间共享的密钥 不为空时请求需要带上HMAC签名 集群中所有节点必须相同
+	SharedSecret []byte
+}
+
+// 能够报告环健康状况的放置策略
+type healthChecker interface {
+	Health() consistenthash.RingHealth
+}
+
+// 支持节点权重的放置策略
+type weightedPlacement interface {
+	AddWeighted(node string, weight int)
+}
+
+// 支持有界负载的放置策略
+type boundedPlacement interface {
+	GetBounded(key string, epsilon float64, load func(node string) int64) string
+}
+
+// 能够按顺序返回key的多个候选节点的放置策略
+type successorPlacement interface {
+	GetN(key string, n int) []string
 }
 
 // httpGetter实际上就是对应远程节点的http client
 type httpGetter struct {
-	baseURL string
+	pool        *HTTPPool
+	peer        string // 节点地址 可能是unix://
+	baseURL     string
+	algorithm   string         // 随请求发送 让对方检查算法是否一致
+	ringVersion string         // 创建时的环版本
+	inflight    atomic.Int64   // 正在向该节点发送的请求数
+	mismatchAt  atomic.Int64   // 最近一次发现对方环版本不同的时间 UnixNano
+	breaker     *breaker       // 请求结果计入熔断器 临时创建的getter没有
+	conn        *PeerConnStats // 连接统计 临时创建的getter没有
 }
 
 func NewHTTPPool(self string) *HTTPPool {
-	return &HTTPPool{
-		self:     self,
-		basePath: defaultBasePath,
+	hp, _ := NewHTTPPoolOpts(self, nil) // 默认配置不会出错
+	return hp
+}
+
+// 使用自定义配置创建HTTPPool o为nil时使用默认配置
+// 配置有误时返回错误 例如证书无法加载或者不认识的放置算法
+func NewHTTPPoolOpts(self string, o *HTTPPoolOptions) (*HTTPPool, error) {
+	hp := &HTTPPool{
+		self: self,
+	}
+	if o != nil {
+		hp.opts = *o
+	}
+	if hp.opts.BasePath == "" {
+		hp.opts.BasePath = defaultBasePath
+	}
+	if hp.opts.Replicas == 0 {
+		hp.opts.Replicas = defaultReplicas
+	}
+	if hp.opts.HealthCheckTimeout == 0 {
+		hp.opts.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+	if hp.opts.FailureThreshold == 0 {
+		hp.opts.FailureThreshold = defaultFailureThreshold
 	}
+	if hp.opts.BreakerOpenTimeout == 0 {
+		hp.opts.BreakerOpenTimeout = defaultBreakerOpenTimeout
+	}
+	if hp.opts.HintMaxBytes == 0 {
+		hp.opts.HintMaxBytes = defaultHintMaxBytes
+	}
+	if hp.opts.HintMaxAge == 0 {
+		hp.opts.HintMaxAge = defaultHintMaxAge
+	}
+	if hp.opts.HintReplayInterval == 0 {
+		hp.opts.HintReplayInterval = defaultHintReplayInterval
+	}
+	if hp.opts.RequestTimeout == 0 {
+		hp.opts.RequestTimeout = defaultRequestTimeout
+	}
+	if hp.opts.DialTimeout == 0 {
+		hp.opts.DialTimeout = defaultDialTimeout
+	}
+	if hp.opts.KeepAlive == 0 {
+		hp.opts.KeepAlive = defaultKeepAlive
+	}
+	if hp.opts.MaxIdleConnsPerHost == 0 {
+		hp.opts.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if hp.opts.IdleConnTimeout == 0 {
+		hp.opts.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if hp.opts.CompressThreshold == 0 {
+		hp.opts.CompressThreshold = defaultCompressThreshold
+	}
+	if hp.opts.StreamThreshold == 0 {
+		hp.opts.StreamThreshold = defaultStreamThreshold
+	}
+	if hp.opts.MaxRequestBytes == 0 {
+		hp.opts.MaxRequestBytes = defaultMaxRequestBytes
+	}
+	if hp.opts.TLS != nil {
+		// unix socket上的请求没有TLS 要求客户端证书时会全部被拒绝
+		if hp.opts.TLS.RequireClientCert && strings.HasPrefix(self, unixScheme) {
+			return nil, fmt.Errorf("RequireClientCert cannot be used with %s, use SharedSecret instead", self)
+		}
+		if err := hp.setupTLS(); err != nil {
+			return nil, err
+		}
+	}
+	hp.client = newPeerClient(&hp.opts, hp.clientTLS)
+	hp.basePath = hp.opts.BasePath
+	if _, err := consistenthash.NewAlgorithm(hp.opts.HashAlgorithm, hp.opts.Replicas); err != nil {
+		return nil, err
+	}
+
+	return hp, nil
 }
 
 // 日志信息
@@ -48,19 +304,77 @@ func (hp *HTTPPool) Log(format string, v ...any) {
 
 // 实现 http.Handler 接口
 func (hp *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == healthPath {
+		hp.serveHealth(w)
+		return
+	}
 	// 确保访问的是缓存对应的path
 	if !strings.HasPrefix(r.URL.Path, hp.basePath) {
 		panic("HTTPPool serving unexpected path: " + r.URL.Path)
 	}
 	// 打印方法和路径
 	hp.Log("(In ServeHTTP) %s %s", r.Method, r.URL.Path)
+	r.Body = http.MaxBytesReader(w, r.Body, hp.opts.MaxRequestBytes)
+	if err := hp.authenticate(r); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		hp.Stats.AuthRejected.Add(1)
+		hp.Log("Rejected unauthenticated request from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// 以_开头的是内部路径 group名不能以_开头
+	rest := r.URL.Path[len(hp.basePath):]
+	switch {
+	case rest == handoffPath:
+		hp.serveHandoff(w, r)
+		return
+	case rest == rangePath:
+		hp.serveRange(w, r)
+		return
+	case rest == writePath:
+		hp.serveWrite(w, r)
+		return
+	case strings.HasPrefix(rest, adminPath):
+		hp.serveAdmin(w, r, rest[len(adminPath):])
+		return
+	}
 	// <basePath>/<Group>/<key>
-	parts := strings.SplitN(r.URL.Path[len(hp.basePath):], "/", 2)
+	parts := strings.SplitN(rest, "/", 2)
 	// 不匹配上述形式
 	if len(parts) != 2 {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	// 只查缓存 与key的归属无关 不检查环的版本
+	if r.Header.Get(peekHeader) != "" {
+		hp.servePeek(w, parts[0], parts[1])
+		return
+	}
+	algorithm, ringVersion := hp.versions()
+	w.Header().Set(ringVersionHeader, ringVersion)
+	// 算法不同的peer对key归属的判断不同 拒绝混用
+	if v := r.Header.Get(algorithmHeader); v != "" && v != algorithm {
+		hp.Stats.AlgorithmRefusals.Add(1)
+		http.Error(w, "Placement algorithm mismatch: "+v, http.StatusConflict)
+		return
+	}
+	// 节点列表不同 双方对key的归属可能有不同的看法
+	if v := r.Header.Get(ringVersionHeader); v != "" && v != ringVersion {
+		hp.Stats.RingMismatches.Add(1)
+		// 收敛之前每个请求都不一致 只在出现新的版本组合时记录
+		if pair := ringVersion + " " + v; hp.lastMismatch.Swap(pair) != pair {
+			hp.Log("Ring version mismatch: local %s, remote %s", ringVersion, v)
+		}
+		if hp.opts.RefuseOnRingMismatch {
+			hp.Stats.RingRefusals.Add(1)
+			http.Error(w, "Ring version mismatch: "+v, http.StatusConflict)
+			return
+		}
+	}
 	// 如果匹配
 	groupName := parts[0]
 	key := parts[1]
@@ -68,14 +382,25 @@ func (hp *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	group := GetGroup(groupName)
 	// 找不到组
 	if group == nil {
-		http.Error(w, "No such Group: "+groupName, http.StatusNotFound)
+		hp.writeError(w, fmt.Errorf("%w: %s", ErrGroupNotFound, groupName))
 		return
 	}
+	// 来自peer的请求只在本地处理 避免双方视图不一致时来回转发
+	hp.Stats.PeerRequests.Add(1)
+	if !hp.isOwner(key) {
+		hp.Stats.ForwardLoops.Add(1)
+		hp.Log("Serving %s/%s locally for %s although it is not the owner", groupName, key, r.Header.Get(forwardedByHeader))
+	}
 	// 找到组
-	cv, err := group.Get(key)
-	// 如果返回error 说明内部错误
+	cv, err := group.getFromLocal(key)
+	// 错误按类型返回状态码 对方可以区分key不存在和数据源故障
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		hp.writeError(w, err)
+		return
+	}
+	// 较大的值直接写出原始数据 不经过protobuf编码
+	if r.Header.Get(acceptStreamHeader) != "" && int64(cv.Len()) >= hp.opts.StreamThreshold {
+		hp.serveStream(w, r, cv)
 		return
 	}
 
@@ -91,38 +416,308 @@ func (hp *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// 一种未知的文件类型应当使用此类型
 	w.Header().Set("Content-Tye", "application/octet-stream")
 	// w.Write(cv.ByteSlice())
+	out, done := hp.compressWriter(w, r, len(body))
+	out.Write(body)
+	done()
+}
+
+// 以protobuf编码的错误响应 http状态码与pb.Status对应
+func (hp *HTTPPool) writeError(w http.ResponseWriter, err error) {
+	body, _ := proto.Marshal(errorResponse(err))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(httpStatus(statusOf(err)))
 	w.Write(body)
 }
 
 // 实例化一致性hash 添加节点 为每个节点创建一个httpGetter（client）
 func (hp *HTTPPool) SetPeers(peers ...string) {
+	hp.setPeers(peers, nil)
+}
+
+// 带权重的SetPeers 权重越大的节点负责的key越多
+// 只有哈希环支持权重 其他放置策略忽略权重
+func (hp *HTTPPool) SetWeightedPeers(weights map[string]int) {
+	peers := make([]string, 0, len(weights))
+	for peer := range weights {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	hp.setPeers(peers, weights)
+}
+
+// 按配置创建放置策略并添加节点
+func (hp *HTTPPool) newPlacement(peers []string, weights map[string]int) consistenthash.Placement {
+	var p consistenthash.Placement
+	switch {
+	case hp.opts.NewPlacement != nil:
+		p = hp.opts.NewPlacement()
+	case hp.opts.HashFn != nil:
+		p = consistenthash.New(hp.opts.Replicas, hp.opts.HashFn)
+	default:
+		// 算法名已经在NewHTTPPoolOpts中检查过
+		p, _ = consistenthash.NewAlgorithm(hp.opts.HashAlgorithm, hp.opts.Replicas)
+	}
+	// 添加节点
+	if wp, ok := p.(weightedPlacement); ok && weights != nil {
+		for _, peer := range peers {
+			wp.AddWeighted(peer, weights[peer])
+		}
+	} else {
+		p.Add(peers...)
+	}
+	return p
+}
+
+func (hp *HTTPPool) setPeers(peers []string, weights map[string]int) {
 	hp.mu.Lock()
 	defer hp.mu.Unlock()
 
-	hp.chash = consistenthash.New(defaultReplicas, nil) // 采用默认的hash函数
-	hp.chash.Add(peers...)                              // 添加节点
-	hp.httpGetters = make(map[string]*httpGetter)       // 延迟初始化
+	// 新加入集群 从之前的owner拉取现在属于自己的条目
+	// 只有自己的环不算加入 例如membership启动时先SetPeers(self) 之后才联系上其他节点
+	if hp.opts.WarmJoin && hp.joined(peers) && !hp.joined(hp.peers) {
+		hp.startWarmup(hp.peers, peers, weights)
+	} else if hp.opts.WarmJoin && len(peers) == 1 && peers[0] == hp.self {
+		hp.warmAlone()
+	}
+
+	if hp.opts.TransitionWindow > 0 && hp.chash != nil {
+		hp.prevChash, hp.prevUntil = hp.chash, time.Now().Add(hp.opts.TransitionWindow)
+		hp.prevGetters = make(map[string]*httpGetter)
+		for peer, getter := range hp.httpGetters {
+			if !contains(peers, peer) {
+				hp.prevGetters[peer] = getter
+			}
+		}
+	}
+
+	hp.chash = hp.newPlacement(peers, weights)
+	hp.successors = nil
+	if _, ok := hp.chash.(successorPlacement); !ok {
+		hp.successors = consistenthash.New64(hp.opts.Replicas, nil)
+		if weights != nil {
+			for _, peer := range peers {
+				hp.successors.AddWeighted(peer, weights[peer])
+			}
+		} else {
+			hp.successors.Add(peers...)
+		}
+	}
+	hp.peers, hp.weights = peers, weights
+	hp.httpGetters = make(map[string]*httpGetter) // 延迟初始化
+
+	hp.algorithm = "custom"
+	if v, ok := hp.chash.(consistenthash.Versioned); ok {
+		hp.algorithm = v.Version()
+	}
+	hp.ringVersion = ringVersion(hp.algorithm, peers, weights)
+	hp.Log("Ring version %s with %d peers", hp.ringVersion, len(peers))
+
+	if hc, ok := hp.chash.(healthChecker); ok {
+		for _, c := range hc.Health().Collisions {
+			hp.Log("Virtual node collision at %d: %s wins over %s", c.Hash, c.Winner, c.Loser)
+		}
+	}
 
 	for _, peer := range peers {
-		hp.httpGetters[peer] = &httpGetter{baseURL: peer + hp.basePath}
+		hp.httpGetters[peer] = &httpGetter{
+			pool:        hp,
+			peer:        peer,
+			baseURL:     peerURL(peer) + hp.basePath,
+			algorithm:   hp.algorithm,
+			ringVersion: hp.ringVersion,
+			breaker:     hp.breakerLocked(peer),
+			conn:        hp.connStatsLocked(peer),
+		}
+	}
+	for peer := range hp.breakers {
+		if !contains(peers, peer) {
+			delete(hp.breakers, peer)
+		}
+	}
+	for peer := range hp.connStats {
+		if !contains(peers, peer) {
+			delete(hp.connStats, peer)
+		}
+	}
+
+	if hp.opts.HealthCheckInterval > 0 {
+		hp.healthOnce.Do(func() { go hp.healthLoop() })
 	}
 }
 
 // 对于传入的key找到真实节点 返回PeerGetter接口
 func (hp *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
+	peer, ok, _ := hp.PickPeerStrict(key)
+	return peer, ok
+}
+
+// 与PickPeer相同 owner是其他节点但熔断或环版本不一致时返回包装了ErrUnavailable的错误
+func (hp *HTTPPool) PickPeerStrict(key string) (PeerGetter, bool, error) {
 	hp.mu.Lock()
 	defer hp.mu.Unlock()
 
+	if hp.chash == nil {
+		return nil, false, nil
+	}
+
 	// 从哈希环中寻找节点
-	if peer := hp.chash.Get(key); peer != "" && peer != hp.self {
+	var peer string
+	if bp, ok := hp.chash.(boundedPlacement); ok && hp.opts.LoadFactor > 0 {
+		peer = bp.GetBounded(key, hp.opts.LoadFactor, hp.peerLoad)
+	} else {
+		peer = hp.chash.Get(key)
+	}
+
+	// owner熔断时改为环上的下一个可用节点 轮到自己时交给调用方按FailurePolicy处理
+	if peer != "" && peer != hp.self && !hp.breakerLocked(peer).allow() {
+		hp.Stats.PeerReroutes.Add(1)
+		owner := peer
+		peer = ""
+		for _, node := range hp.successorsLocked(key) {
+			if node != owner && (node == hp.self || hp.breakerLocked(node).allow()) {
+				peer = node
+				break
+			}
+		}
+		hp.Log("Peer %s is unhealthy, rerouting %s to %s", owner, key, peer)
+		if peer == "" || peer == hp.self {
+			return nil, false, fmt.Errorf("%w: owner %s is unhealthy", ErrUnavailable, owner)
+		}
+	}
+
+	if peer != "" && peer != hp.self {
+		getter := hp.httpGetters[peer]
+		// 严格模式下 对方的节点列表和自己不同时不转发 等待收敛
+		// 每隔ringMismatchBackoff放行一次请求 以便发现对方已经收敛
+		if hp.opts.RefuseOnRingMismatch {
+			if at := getter.mismatchAt.Load(); at != 0 && time.Since(time.Unix(0, at)) < ringMismatchBackoff {
+				hp.Stats.RingRefusals.Add(1)
+				return nil, false, fmt.Errorf("%w: ring version mismatch with %s", ErrUnavailable, peer)
+			}
+		}
 		hp.Log("Pick Peer %s", peer)
 		// 返回对应节点的httpgetter 即 client
-		return hp.httpGetters[peer], true
+		return getter, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// key在环上的owner 与PickPeer不同 不考虑熔断和有界负载
+func (hp *HTTPPool) PickOwner(key string) (PeerGetter, bool) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if hp.chash == nil {
+		return nil, false
+	}
+	peer := hp.chash.Get(key)
+	if peer == "" || peer == hp.self {
+		return nil, false
 	}
+	return hp.httpGetters[peer], true
+}
 
+func contains(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// 临时使用的getter 不计入熔断和连接统计
+func (hp *HTTPPool) newGetter(peer string) *httpGetter {
+	return &httpGetter{pool: hp, peer: peer, baseURL: peerURL(peer) + hp.basePath}
+}
+
+// 环上failed之后的下一个节点 failed为nil表示owner不可用 没有发出请求
+func (hp *HTTPPool) PickNextPeer(key string, failed PeerGetter) (PeerGetter, bool) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if hp.chash == nil {
+		return nil, false
+	}
+	for i, node := range hp.successorsLocked(key) {
+		if failed == nil && i == 0 {
+			continue
+		}
+		if getter, ok := hp.httpGetters[node]; ok && getter == failed {
+			continue
+		}
+		if node == hp.self {
+			return nil, false
+		}
+		if getter, ok := hp.httpGetters[node]; ok && getter.breaker.allow() {
+			return getter, true
+		}
+	}
 	return nil, false
 }
 
+// 按自己的环 key是否属于自己
+func (hp *HTTPPool) isOwner(key string) bool {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if hp.chash == nil {
+		return true
+	}
+	owner := hp.chash.Get(key)
+	return owner == "" || owner == hp.self
+}
+
+func (hp *HTTPPool) versions() (algorithm, ringVersion string) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	return hp.algorithm, hp.ringVersion
+}
+
+// 当前哈希环的版本
+func (hp *HTTPPool) RingVersion() string {
+	_, v := hp.versions()
+	return v
+}
+
+// 对放置算法和排序后的节点列表(包括权重)做hash
+// 版本相同的两个节点对任意key的归属判断一定相同
+func ringVersion(algorithm string, peers []string, weights map[string]int) string {
+	sorted := append([]string(nil), peers...)
+	sort.Strings(sorted)
+
+	h := fnv.New64a()
+	io.WriteString(h, algorithm)
+	for _, peer := range sorted {
+		w := 1
+		if weights != nil && weights[peer] > 1 {
+			w = weights[peer]
+		}
+		fmt.Fprintf(h, "\n%s=%d", peer, w)
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// 哈希环的健康检查 当前放置策略不是哈希环时返回false
+func (hp *HTTPPool) RingHealth() (consistenthash.RingHealth, bool) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if hc, ok := hp.chash.(healthChecker); ok {
+		return hc.Health(), true
+	}
+	return consistenthash.RingHealth{}, false
+}
+
+// 节点当前的在途请求数 调用时需持有hp.mu
+func (hp *HTTPPool) peerLoad(peer string) int64 {
+	if getter, ok := hp.httpGetters[peer]; ok {
+		return getter.inflight.Load()
+	}
+	return 0
+}
+
 // 这行代码是一个类型断言，它将*HTTPPool指针断言为PeerPicker接口类型。这通常用于接口的实现声明，
 // 这里它表明HTTPPool实现了PeerPicker接口。
 var _ PeerPicker = (*HTTPPool)(nil)
@@ -132,35 +727,145 @@ var _ PeerPicker = (*HTTPPool)(nil)
 // 实现PeerGetter接口
 // func (hg *httpGetter) Get(group string, key string) ([]byte, error) {
 func (hg *httpGetter) Get(in *pb.Request, out *pb.Response) error {
+	return hg.GetContext(context.Background(), in, out)
+}
+
+func (hg *httpGetter) GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	hg.inflight.Add(1)
+	defer hg.inflight.Add(-1)
+
+	start := time.Now()
+	res, err := hg.send(ctx, in)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// 原始数据 按长度一次分配
+	if res.Header.Get(streamHeader) != "" {
+		if out.Value, err = readStream(res); err != nil {
+			return err
+		}
+	} else {
+		// ok了 读取数据
+		bytes, err := io.ReadAll(res.Body) // read until an error or EOF and returns the data it read
+		if err != nil {
+			return fmt.Errorf("[ERROR] Reading response body: %v", err)
+		}
+		// Decode
+		if err = proto.Unmarshal(bytes, out); err != nil {
+			return fmt.Errorf("decoding response body: %v", err)
+		}
+	}
+	if !in.Peek {
+		hg.pool.latency.add(time.Since(start))
+	}
+
+	return nil
+}
+
+// 发送Get请求并检查状态码 调用方负责关闭返回的响应
+func (hg *httpGetter) send(ctx context.Context, in *pb.Request) (*http.Response, error) {
 	info := fmt.Sprintf(
 		"%v%v/%v", // %v按原本值输出
 		hg.baseURL,
 		url.QueryEscape(in.GetGroup()), // QueryEscape 会对字符串进行转义处理，以便将其安全地放入 URL 查询中
 		url.QueryEscape(in.GetKey()),
 	)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, info, nil)
+	if err != nil {
+		return nil, err
+	}
+	if in.RingVersion == "" {
+		in.RingVersion = hg.ringVersion
+	}
+	if in.ForwardedBy == "" {
+		in.ForwardedBy = hg.pool.self
+	}
+	req.Header.Set(algorithmHeader, hg.algorithm)
+	req.Header.Set(ringVersionHeader, in.RingVersion)
+	req.Header.Set(forwardedByHeader, in.ForwardedBy)
+	req.Header.Set(acceptStreamHeader, "1")
+	// 自己设置了Accept-Encoding之后Transport不会自动解压 由decodeBody处理
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	if in.Peek {
+		req.Header.Set(peekHeader, "1")
+		hg.pool.Stats.PreviousPeeks.Add(1)
+	}
+	// 熔断器在真正发送时才占用试探机会
+	ok, trial := hg.breaker.acquire()
+	if !ok {
+		return nil, errBreakerOpen
+	}
 	// Get方法
-	res, err := http.Get(info)
+	res, err := hg.do(req, nil)
 	// 有错误
 	if err != nil {
-		return err
+		// 被取消的对冲请求不算节点故障 也不算试探的结果 超时仍然算作故障
+		if ctx.Err() != context.Canceled {
+			hg.breaker.failure()
+		} else if trial {
+			hg.breaker.release()
+		}
+		return nil, err
 	}
 
-	defer res.Body.Close()
-	// 不是200
+	var resErr error
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("[ERROR] Server returned: %v", res.Status)
+		resErr = readError(res)
 	}
-	// ok了 读取数据
-	bytes, err := io.ReadAll(res.Body) // read until an error or EOF and returns the data it read
-	if err != nil {
-		return fmt.Errorf("[ERROR] Reading response body: %v", err)
+	// 带状态码的错误是对方给出的回答 例如数据源不可用 只有其他的503算作节点故障
+	var pe *peerError
+	if res.StatusCode == http.StatusServiceUnavailable && !errors.As(resErr, &pe) {
+		hg.breaker.failure()
+	} else {
+		hg.breaker.success()
+	}
+	if !in.Peek {
+		hg.checkRingVersion(in.RingVersion, res.Header.Get(ringVersionHeader))
 	}
-	// Decode
-	if err = proto.Unmarshal(bytes, out); err != nil {
-		return fmt.Errorf("decoding response body: %v", err)
+	// 不是200
+	if resErr != nil {
+		return nil, resErr
+	}
+	if in.Peek {
+		hg.pool.Stats.PreviousHits.Add(1)
+	}
+	if err := decodeBody(res); err != nil {
+		res.Body.Close()
+		return nil, err
 	}
+	return res, nil
+}
 
-	return nil
+// 读取错误响应并关闭 带状态码时还原成对应的错误
+func readError(res *http.Response) error {
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") == "application/octet-stream" {
+		body, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+		out := &pb.Response{}
+		if err == nil && proto.Unmarshal(body, out) == nil {
+			if err := responseError(out); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("[ERROR] Server returned: %v", res.Status)
+}
+
+// 记录对方的环版本是否和自己一致
+func (hg *httpGetter) checkRingVersion(local, remote string) {
+	// 只在一致和不一致之间变化时记录日志
+	if remote == "" || remote == local {
+		if hg.mismatchAt.Swap(0) != 0 {
+			hg.pool.Log("Ring version of %s agrees again: %s", hg.baseURL, local)
+		}
+		return
+	}
+	hg.pool.Stats.RingMismatches.Add(1)
+	if hg.mismatchAt.Swap(time.Now().UnixNano()) == 0 {
+		hg.pool.Log("Ring version mismatch with %s: local %s, remote %s", hg.baseURL, local, remote)
+	}
 }
 
 var _ PeerGetter = (*httpGetter)(nil)
@@ -0,0 +1,932 @@
+package mycache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mycache/consistenthash"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	pb "mycache/mycachepb"
+)
+
+// 启动一个HTTPPool 返回pool和它的地址
+// 测试中的配置都是正确的
+func newPool(t testing.TB, self string, opts *HTTPPoolOptions) *HTTPPool {
+	pool, err := NewHTTPPoolOpts(self, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func newTestPool(t testing.TB, opts *HTTPPoolOptions) (*HTTPPool, string) {
+	srv := httptest.NewServer(nil)
+	t.Cleanup(srv.Close)
+	pool := newPool(t, srv.URL, opts)
+	srv.Config.Handler = pool
+	return pool, srv.URL
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestGroup(name string) *Group {
+	return NewGroup(name, 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		if v, ok := db[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("%s not exist", key)
+	}))
+}
+
+func TestRingVersionMismatch(t *testing.T) {
+	newTestGroup("ring-version")
+	a, addrA := newTestPool(t, &HTTPPoolOptions{RefuseOnRingMismatch: true})
+	b, addrB := newTestPool(t, &HTTPPoolOptions{RefuseOnRingMismatch: true})
+
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+	if a.RingVersion() != b.RingVersion() {
+		t.Fatalf("same peers should give the same ring version, got %s and %s", a.RingVersion(), b.RingVersion())
+	}
+
+	getter := a.httpGetters[addrB]
+	res := &pb.Response{}
+	if err := getter.Get(&pb.Request{Group: "ring-version", Key: "Tom"}, res); err != nil || string(res.Value) != "630" {
+		t.Fatalf("get with matching rings failed: %v", err)
+	}
+
+	// b 看到了一个新节点 a 还没有
+	b.SetPeers(addrA, addrB, "http://localhost:1")
+	if err := getter.Get(&pb.Request{Group: "ring-version", Key: "Tom"}, res); err == nil {
+		t.Fatal("request with a stale ring should be refused")
+	}
+	if b.Stats.RingRefusals.Get() != 1 || a.Stats.RingMismatches.Get() != 1 {
+		t.Errorf("mismatch should be counted on both sides, got refusals %s, mismatches %s", &b.Stats.RingRefusals, &a.Stats.RingMismatches)
+	}
+
+	// 收敛之前的请求仍然计数 但不再重复记录日志
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	for i := 0; i < 3; i++ {
+		getter.Get(&pb.Request{Group: "ring-version", Key: "Tom"}, res)
+	}
+	if n := strings.Count(buf.String(), "Ring version mismatch"); n != 0 || a.Stats.RingMismatches.Get() != 4 {
+		t.Errorf("repeated mismatches should only be counted, got %d log lines and %s mismatches", n, &a.Stats.RingMismatches)
+	}
+}
+
+func TestNoForwardLoop(t *testing.T) {
+	loads := 0
+	NewGroup("forward-loop", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(db[key]), nil
+	}))
+	a, addrA := newTestPool(t, nil)
+	b, addrB := newTestPool(t, nil)
+
+	// a 认为key属于b，b 认为key属于a
+	a.SetPeers(addrB)
+	b.SetPeers(addrA)
+
+	res := &pb.Response{}
+	if err := a.httpGetters[addrB].Get(&pb.Request{Group: "forward-loop", Key: "Tom"}, res); err != nil || string(res.Value) != "630" {
+		t.Fatalf("get failed: %v", err)
+	}
+	if loads != 1 {
+		t.Errorf("b should load the key locally once, got %d", loads)
+	}
+	if b.Stats.ForwardLoops.Get() != 1 {
+		t.Errorf("b should count one forwarding violation, got %s", &b.Stats.ForwardLoops)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	g := newTestGroup("drain")
+	for k := range db {
+		g.GetLocally(k)
+	}
+
+	// 没有配置认证时不接受下线请求
+	_, addrC := newTestPool(t, nil)
+	res, err := http.Post(addrC+defaultBasePath+adminPath+"drain", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("drain without auth should be forbidden, got %s", res.Status)
+	}
+
+	drained := make(chan struct{})
+	secret := []byte("s3cret")
+	a, addrA := newTestPool(t, &HTTPPoolOptions{OnDrained: func() { close(drained) }, SharedSecret: secret})
+	b, addrB := newTestPool(t, &HTTPPoolOptions{SharedSecret: secret})
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+
+	req, _ := http.NewRequest(http.MethodPost, addrA+defaultBasePath+adminPath+"drain", nil)
+	a.sign(req, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusAccepted {
+		t.Fatalf("starting drain failed: %v %v", err, res.Status)
+	}
+	res.Body.Close()
+	<-drained
+
+	// 同一进程中其他测试的group也会被迁移
+	status := a.DrainStatus()
+	if status.State != DrainDone || status.Sent < int64(len(db)) || status.Failed != 0 {
+		t.Fatalf("unexpected drain status %+v", status)
+	}
+	if b.Stats.HandoffReceived.Get() != status.Sent {
+		t.Errorf("b should receive %d entries, got %s", status.Sent, &b.Stats.HandoffReceived)
+	}
+	if owner, ok := a.PickPeer("Tom"); !ok || owner.(*httpGetter).baseURL != addrB+defaultBasePath {
+		t.Errorf("drained node should route everything to the remaining peers")
+	}
+}
+
+func TestWarmJoin(t *testing.T) {
+	g := newTestGroup("warm-join")
+	for k := range db {
+		g.GetLocally(k)
+	}
+
+	a, addrA := newTestPool(t, nil)
+	b, addrB := newTestPool(t, &HTTPPoolOptions{WarmJoin: true})
+	if b.Ready() {
+		t.Fatal("node should not be ready before joining")
+	}
+	a.SetPeers(addrA)
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("warm up did not finish: %+v", b.WarmupStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 同一进程中其他测试的group也会被拉取
+	owned := 0
+	for k := range db {
+		if !a.isOwner(k) {
+			owned++
+		}
+	}
+	status := b.WarmupStatus()
+	if status.Sources != 1 || status.Entries < int64(owned) || len(status.Errors) != 0 {
+		t.Fatalf("unexpected warm up status %+v, want at least %d entries", status, owned)
+	}
+
+	res, err := http.Get(addrB + defaultBasePath + adminPath + "ready")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("ready endpoint should report ready: %v", err)
+	}
+	res.Body.Close()
+}
+
+// membership启动时先SetPeers(self) 联系上其他节点之后才真正加入集群
+func TestWarmJoinAfterAlone(t *testing.T) {
+	newTestGroup("warm-alone")
+	a, addrA := newTestPool(t, nil)
+	b, addrB := newTestPool(t, &HTTPPoolOptions{WarmJoin: true})
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrB)
+	if status := b.WarmupStatus(); status.State != WarmupReady || status.Sources != 0 {
+		t.Fatalf("a node alone has nothing to pull, got %+v", status)
+	}
+
+	b.SetPeers(addrA, addrB)
+	waitFor(t, "warm up to finish", b.Ready)
+	if status := b.WarmupStatus(); status.Sources != 1 || len(status.Errors) != 0 {
+		t.Fatalf("joining after being alone should pull from a, got %+v", status)
+	}
+}
+
+func TestWarmupFailed(t *testing.T) {
+	b, addrB := newTestPool(t, &HTTPPoolOptions{WarmJoin: true})
+	b.SetPeers(addrB)
+	b.SetPeers("http://127.0.0.1:1", addrB)
+	waitFor(t, "warm up to fail", func() bool { return b.WarmupStatus().State == WarmupFailed })
+	if b.Ready() || len(b.WarmupStatus().Errors) == 0 {
+		t.Fatalf("a failed warm up should not be ready, got %+v", b.WarmupStatus())
+	}
+}
+
+// 分页期间LRU的顺序变化不会导致遗漏或重复
+func TestRangeCursor(t *testing.T) {
+	g := newTestGroup("warm-cursor")
+	for k := range db {
+		g.GetLocally(k)
+	}
+	a, addrA := newTestPool(t, nil)
+	a.SetPeers(addrA)
+	getter := a.newGetter(addrA)
+
+	// 所有key都属于requester
+	req := &pb.RangeRequest{Requester: "http://localhost:9", Peers: []string{"http://localhost:9"}, Limit: 1}
+	seen := make(map[string]bool)
+	var snap *rangeSnapshot
+	for {
+		res, err := getter.getRange(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 之后的页复用第一页生成的快照
+		if res.More {
+			a.ranges.mu.Lock()
+			s := a.ranges.snaps[req.Requester]
+			a.ranges.mu.Unlock()
+			if snap != nil && s != snap {
+				t.Fatal("later pages should reuse the snapshot")
+			}
+			snap = s
+		}
+		for _, e := range res.Entries {
+			if seen[e.Group+"/"+e.Key] {
+				t.Fatalf("%s/%s returned twice", e.Group, e.Key)
+			}
+			seen[e.Group+"/"+e.Key] = true
+		}
+		if !res.More {
+			break
+		}
+		last := res.Entries[len(res.Entries)-1]
+		req.AfterGroup, req.AfterKey = last.Group, last.Key
+		// 访问所有key 改变LRU中的顺序
+		for k := range db {
+			g.Get(k)
+		}
+	}
+	for k := range db {
+		if !seen["warm-cursor/"+k] {
+			t.Errorf("%s was not returned", k)
+		}
+	}
+	if len(a.ranges.snaps) != 0 {
+		t.Error("snapshot should be dropped after the last page")
+	}
+}
+
+func TestTransitionPeek(t *testing.T) {
+	loads := 0
+	g := NewGroup("transition", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(db[key]), nil
+	}))
+	a, addrA := newTestPool(t, nil)
+	a.SetPeers(addrA)
+	for k := range db {
+		g.GetLocally(k)
+	}
+	loads = 0
+
+	// a 离开 b 成为所有key的新owner 过渡期内先向a查询
+	b := newPool(t, "http://localhost:2", &HTTPPoolOptions{TransitionWindow: time.Minute})
+	b.SetPeers(addrA)
+	b.SetPeers("http://localhost:2")
+	for k, v := range db {
+		peer, ok := b.PickPreviousPeer(k)
+		if !ok {
+			t.Fatalf("%s moved from a to b, previous owner should be picked", k)
+		}
+		res := &pb.Response{}
+		if err := peer.Get(&pb.Request{Group: "transition", Key: k, Peek: true}, res); err != nil || string(res.Value) != v {
+			t.Fatalf("peek %s at previous owner failed: %v", k, err)
+		}
+	}
+	if loads != 0 {
+		t.Errorf("peek should never load from the source, got %d loads", loads)
+	}
+	if b.Stats.PreviousHits.Get() != int64(len(db)) {
+		t.Errorf("expected %d hits at the previous owner, got %s", len(db), &b.Stats.PreviousHits)
+	}
+
+	peer, _ := b.PickPreviousPeer("Tom")
+	if err := peer.Get(&pb.Request{Group: "transition", Key: "unknown", Peek: true}, &pb.Response{}); err == nil {
+		t.Error("peek of an uncached key should fail")
+	}
+
+	// 过渡期结束之后不再查询旧owner
+	b.prevUntil = time.Now()
+	if _, ok := b.PickPreviousPeer("Tom"); ok {
+		t.Error("previous ring should be dropped after the transition window")
+	}
+}
+
+// 旧owner已经宕机 查询很快超时 熔断之后不再查询
+func TestTransitionPreviousDown(t *testing.T) {
+	loads := 0
+	g := NewGroup("transition-down", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(db[key]), nil
+	}))
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(stuck.Close)
+
+	b := newPool(t, "http://localhost:2", &HTTPPoolOptions{TransitionWindow: time.Minute, FailureThreshold: 1, BreakerOpenTimeout: time.Minute})
+	b.SetPeers(stuck.URL)
+	b.SetPeers("http://localhost:2")
+	g.RegisterPeers(b)
+
+	start := time.Now()
+	if v, err := g.Get("Tom"); err != nil || v.String() != db["Tom"] {
+		t.Fatalf("get should fall back to the source: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("peek at a stuck previous owner should time out quickly, took %v", elapsed)
+	}
+	if _, ok := b.PickPreviousPeer("Jack"); ok {
+		t.Error("previous owner with an open breaker should be skipped")
+	}
+	if loads != 1 || b.Stats.PreviousPeeks.Get() != 1 {
+		t.Errorf("expected 1 load and 1 peek, got %d loads and %s peeks", loads, &b.Stats.PreviousPeeks)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	g := newTestGroup("hint")
+	a, addrA := newTestPool(t, &HTTPPoolOptions{HintReplayInterval: 10 * time.Millisecond})
+
+	// 先占一个端口再关闭 owner c 暂时不可达
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrC := "http://" + l.Addr().String()
+	l.Close()
+
+	a.SetPeers(addrA, addrC)
+	key := ""
+	for k := range db {
+		if !a.isOwner(k) {
+			key = k
+			break
+		}
+	}
+	if key == "" {
+		t.Skip("no key owned by c")
+	}
+
+	getter := a.httpGetters[addrC]
+	for _, v := range []string{"1", "2"} {
+		if err := getter.Write(&pb.WriteRequest{Group: "hint", Key: key, Value: []byte(v)}); err != nil {
+			t.Fatalf("write to an unreachable owner should be handed off: %v", err)
+		}
+	}
+	if n, _ := a.Hints(); n != 1 {
+		t.Fatalf("successor should keep only the last write of a key, got %d hints", n)
+	}
+
+	// c 恢复之后 hint 重放给它
+	l, err = net.Listen("tcp", addrC[len("http://"):])
+	if err != nil {
+		t.Skipf("cannot reuse %s: %v", addrC, err)
+	}
+	srv := httptest.NewUnstartedServer(newPool(t, addrC, nil))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats.HintsReplayed.Get() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("hint was not replayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, ok := g.mcache.Get(key); !ok || v.String() != "2" {
+		t.Errorf("owner should have the last written value, got %q", v.String())
+	}
+	if n, _ := a.Hints(); n != 0 {
+		t.Errorf("replayed hints should be removed, %d left", n)
+	}
+}
+
+func TestWriteToOpenBreaker(t *testing.T) {
+	g := newTestGroup("hint-breaker")
+	a, addrA := newTestPool(t, &HTTPPoolOptions{HintReplayInterval: time.Hour, BreakerOpenTimeout: time.Minute})
+	_, addrB := newTestPool(t, nil)
+	c, addrC := newTestPool(t, &HTTPPoolOptions{HintReplayInterval: time.Hour})
+	a.SetPeers(addrA, addrB, addrC)
+	c.SetPeers(addrA, addrB, addrC)
+	g.RegisterPeers(a)
+
+	// b是owner c是b的后继
+	keys := make([]string, 0, 2)
+	for i := 0; i < 1000 && len(keys) < 2; i++ {
+		k := fmt.Sprintf("key%d", i)
+		a.mu.Lock()
+		nodes := a.successorsLocked(k)
+		a.mu.Unlock()
+		if nodes[0] == addrB && nodes[1] == addrC {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) < 2 {
+		t.Skip("not enough keys owned by b with c as the successor")
+	}
+	open := func(getter *httpGetter) {
+		for i := 0; i < a.opts.FailureThreshold; i++ {
+			getter.breaker.failure()
+		}
+	}
+	open(a.httpGetters[addrB])
+
+	// owner熔断时写入不能改发给其他节点 hint交给后继c
+	if err := g.Set(keys[0], []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := c.Hints(); n != 1 {
+		t.Errorf("write to an open owner should be handed to the successor, got %d hints", n)
+	}
+	if n, _ := a.Hints(); n != 0 {
+		t.Errorf("hint should not be stored locally while the successor is up, got %d hints", n)
+	}
+	if _, ok := g.mcache.Get(keys[0]); ok {
+		t.Error("write should not be applied on a non-owner")
+	}
+
+	// 后继也熔断时在本地暂存
+	open(a.httpGetters[addrC])
+	if err := g.Set(keys[1], []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := a.Hints(); n != 1 {
+		t.Errorf("hint should be stored locally when the successor is also open, got %d hints", n)
+	}
+}
+
+func TestHintLimits(t *testing.T) {
+	hp := newPool(t, "http://localhost:3", &HTTPPoolOptions{HintMaxBytes: 20, HintMaxAge: time.Nanosecond})
+	for _, k := range []string{"k1", "k2", "k3"} {
+		hp.hintMu.Lock()
+		hp.addHintLocked(&hint{owner: "http://localhost:4", req: &pb.WriteRequest{Key: k}, size: 8, at: time.Now()})
+		hp.hintMu.Unlock()
+	}
+	if n, size := hp.Hints(); n != 2 || size != 16 || hp.Stats.HintsDropped.Get() != 1 {
+		t.Fatalf("oldest hint should be dropped over the size limit, got %d hints, %d bytes", n, size)
+	}
+
+	time.Sleep(time.Millisecond)
+	hp.replayHints()
+	if n, _ := hp.Hints(); n != 0 || hp.Stats.HintsDropped.Get() != 3 {
+		t.Errorf("expired hints should be dropped, got %d hints left", n)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	a, addrA := newTestPool(t, &HTTPPoolOptions{
+		HealthCheckInterval: 10 * time.Millisecond,
+		FailureThreshold:    1,
+		BreakerOpenTimeout:  time.Minute,
+	})
+	_, addrB := newTestPool(t, nil)
+	addrC := "http://localhost:1"
+	a.SetPeers(addrA, addrB, addrC)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.PeerHealth()[addrC] != BreakerOpen {
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker of an unreachable peer should open, got %v", a.PeerHealth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := a.PeerHealth()[addrB]; state != BreakerClosed {
+		t.Fatalf("healthy peer should stay closed, got %s", state)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if peer, ok := a.PickPeer(key); ok && peer.(*httpGetter).baseURL == addrC+defaultBasePath {
+			t.Fatalf("%s should not be routed to an open peer", key)
+		}
+	}
+	if a.Stats.PeerReroutes.Get() == 0 {
+		t.Error("keys owned by the open peer should be rerouted")
+	}
+
+	res, err := http.Get(addrB + healthPath)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("healthz should report ok: %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := newBreaker(2, time.Millisecond, &PoolStats{})
+	b.failure()
+	if !b.allow() {
+		t.Fatal("breaker should stay closed below the threshold")
+	}
+	b.failure()
+	if b.allow() || b.State() != BreakerOpen {
+		t.Fatal("breaker should open at the threshold")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if !b.allow() || !b.allow() {
+		t.Fatal("checking a breaker should not use up the trial")
+	}
+	if ok, trial := b.acquire(); !ok || !trial {
+		t.Fatal("first request after the timeout should be the trial")
+	}
+	if ok, _ := b.acquire(); ok {
+		t.Fatal("half-open breaker should let exactly one trial through")
+	}
+	// 取消的试探请求没有结果 下一个请求重新试探
+	b.release()
+	if ok, _ := b.acquire(); !ok {
+		t.Fatal("released trial should let the next request through")
+	}
+	b.failure()
+	if b.State() != BreakerOpen {
+		t.Fatal("failed trial should reopen the breaker")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	b.acquire()
+	b.success()
+	if b.State() != BreakerClosed || !b.allow() {
+		t.Fatal("successful trial should close the breaker")
+	}
+}
+
+func TestCancelledTrial(t *testing.T) {
+	newTestGroup("cancelled-trial")
+	a, addrA := newTestPool(t, &HTTPPoolOptions{FailureThreshold: 1, BreakerOpenTimeout: time.Millisecond})
+	b, addrB := newTestPool(t, nil)
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+	getter := a.httpGetters[addrB]
+	getter.breaker.failure()
+	time.Sleep(2 * time.Millisecond)
+
+	// 被取消的试探请求不能一直占着试探机会
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := getter.GetContext(ctx, &pb.Request{Group: "cancelled-trial", Key: "Tom"}, &pb.Response{}); err == nil {
+		t.Fatal("cancelled request should fail")
+	}
+	if !getter.breaker.allow() {
+		t.Fatal("cancelled trial should be released")
+	}
+	if err := getter.Get(&pb.Request{Group: "cancelled-trial", Key: "Tom"}, &pb.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	if state := getter.breaker.State(); state != BreakerClosed {
+		t.Errorf("successful trial should close the breaker, got %s", state)
+	}
+}
+
+func TestSuccessorsWithoutGetN(t *testing.T) {
+	a := newPool(t, "http://a", &HTTPPoolOptions{
+		NewPlacement: func() consistenthash.Placement { return consistenthash.NewMaglev(0, nil) },
+	})
+	peers := []string{"http://a", "http://b", "http://c", "http://d"}
+	a.SetPeers(peers...)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		nodes := a.successorsLocked(key)
+		if len(nodes) != len(peers) || nodes[0] != a.chash.Get(key) {
+			t.Fatalf("%s: successors should start with the owner and cover all peers, got %v", key, nodes)
+		}
+	}
+}
+
+func TestHedgedRequest(t *testing.T) {
+	var loads AtomicInt
+	g := NewGroup("hedge", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads.Add(1)
+		return []byte("v-" + key), nil
+	}))
+	a, addrA := newTestPool(t, &HTTPPoolOptions{HedgeBudget: 1})
+	c, addrC := newTestPool(t, nil)
+
+	// b 卡住 直到请求被取消
+	var slow AtomicInt
+	slow.Add(int64(5 * time.Second))
+	cancelled := make(chan struct{}, 1)
+	srvB := httptest.NewServer(nil)
+	t.Cleanup(srvB.Close)
+	poolB := newPool(t, srvB.URL, nil)
+	srvB.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Duration(slow.Get())):
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+			return
+		}
+		poolB.ServeHTTP(w, r)
+	})
+	addrB := srvB.URL
+
+	a.SetPeers(addrA, addrB, addrC)
+	poolB.SetPeers(addrA, addrB, addrC)
+	c.SetPeers(addrA, addrB, addrC)
+	g.RegisterPeers(a)
+	for i := 0; i < latencyMinSamples; i++ {
+		a.latency.add(time.Millisecond)
+	}
+
+	var key string
+	var primary PeerGetter
+	for i := 0; i < 100 && primary == nil; i++ {
+		key = fmt.Sprintf("key%d", i)
+		if peer, ok := a.PickPeer(key); ok && peer.(*httpGetter).baseURL == addrB+defaultBasePath {
+			primary = peer
+		}
+	}
+	if primary == nil {
+		t.Skip("no key owned by b")
+	}
+
+	// 对冲请求发给owner的后继c c没有缓存时回源 不用等待b
+	if replica, _, ok := a.PickHedge(key, primary); !ok || replica.(*httpGetter).baseURL != addrC+defaultBasePath {
+		t.Fatalf("hedge should go to the successor of b")
+	}
+	start := time.Now()
+	view, err := g.GetFromPeer(primary, key)
+	if err != nil || view.String() != "v-"+key {
+		t.Fatalf("hedged get failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hedge should answer before the slow peer, took %v", elapsed)
+	}
+	if a.Stats.Hedges.Get() != 1 || loads.Get() != 1 {
+		t.Errorf("expected one hedge served by c, got %s hedges and %s loads", &a.Stats.Hedges, &loads)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("request to the slow peer should be cancelled")
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	hp := newPool(t, "http://localhost:3", &HTTPPoolOptions{HedgeBudget: 0.5})
+	hp.peerFetches.Add(2)
+	if !hp.AllowHedge() || hp.AllowHedge() {
+		t.Fatal("budget of 50% should allow one hedge for two requests")
+	}
+	if hp.Stats.HedgesOverBudget.Get() != 1 {
+		t.Errorf("expected one hedge over budget, got %s", &hp.Stats.HedgesOverBudget)
+	}
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestPeerConnections(t *testing.T) {
+	newTestGroup("conn")
+	a, addrA := newTestPool(t, nil)
+	b, addrB := newTestPool(t, nil)
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+
+	for i := 0; i < 5; i++ {
+		if err := a.httpGetters[addrB].Get(&pb.Request{Group: "conn", Key: "Tom"}, &pb.Response{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := a.PeerConnStats()[addrB]
+	if stats.Requests.Get() != 5 || stats.NewConns.Get() != 1 || stats.ReusedConns.Get() != 4 {
+		t.Errorf("expected 5 requests over one kept-alive connection, got %s requests, %s new, %s reused",
+			&stats.Requests, &stats.NewConns, &stats.ReusedConns)
+	}
+
+	// 自定义的client
+	transport := &countingTransport{}
+	c, addrC := newTestPool(t, &HTTPPoolOptions{Client: &http.Client{Transport: transport}})
+	c.SetPeers(addrC, addrB)
+	if err := c.httpGetters[addrB].Get(&pb.Request{Group: "conn", Key: "Tom"}, &pb.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests != 1 {
+		t.Errorf("configured client should be used, got %d requests", transport.requests)
+	}
+}
+
+// 启动一个监听unix socket的HTTPPool
+func newUnixTestPool(t *testing.T, path string) (*HTTPPool, string) {
+	addr := "unix://" + path
+	l, err := Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newPool(t, addr, nil)
+	srv := &http.Server{Handler: pool}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return pool, addr
+}
+
+func TestUnixSocket(t *testing.T) {
+	newTestGroup("unix")
+	dir := t.TempDir()
+	a, addrA := newUnixTestPool(t, dir+"/a.sock")
+	b, addrB := newUnixTestPool(t, dir+"/b.sock")
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+
+	res := &pb.Response{}
+	if err := a.httpGetters[addrB].Get(&pb.Request{Group: "unix", Key: "Tom"}, res); err != nil || string(res.Value) != "630" {
+		t.Fatalf("get over unix socket failed: %v", err)
+	}
+	if err := a.httpGetters[addrB].Write(&pb.WriteRequest{Group: "unix", Key: "Jack", Value: []byte("600")}); err != nil {
+		t.Fatalf("write over unix socket failed: %v", err)
+	}
+	if b.Stats.PeerRequests.Get() != 1 {
+		t.Errorf("b should serve the request, got %s", &b.Stats.PeerRequests)
+	}
+
+	// 重新监听同一个路径 残留的socket文件会被删除
+	l, err := Listen(addrA)
+	if err != nil {
+		t.Fatalf("listening on a stale socket failed: %v", err)
+	}
+	l.Close()
+}
+
+func TestStreamLargeValue(t *testing.T) {
+	large := strings.Repeat("report ", 300<<10) // 2MB多
+	g := NewGroup("stream", 8<<20, GetterFunc(func(key string) ([]byte, error) {
+		if key == "small" {
+			return []byte("tiny"), nil
+		}
+		return []byte(large), nil
+	}))
+	a, addrA := newTestPool(t, nil)
+	b, addrB := newTestPool(t, nil)
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+	g.RegisterPeers(a)
+
+	res := &pb.Response{}
+	if err := a.httpGetters[addrB].Get(&pb.Request{Group: "stream", Key: "large"}, res); err != nil || string(res.Value) != large {
+		t.Fatalf("get of a large value failed: %v", err)
+	}
+	if b.Stats.StreamsSent.Get() != 1 {
+		t.Errorf("large value should be sent raw, got %s", &b.Stats.StreamsSent)
+	}
+
+	for _, key := range []string{"large", "small"} {
+		rc, err := a.httpGetters[addrB].GetStream(context.Background(), &pb.Request{Group: "stream", Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, rc)
+		rc.Close()
+		if want, _ := g.getter.Get(key); buf.String() != string(want) {
+			t.Errorf("streamed %s has %d bytes, want %d", key, buf.Len(), len(want))
+		}
+	}
+	if a.Stats.StreamsReceived.Get() != 1 {
+		t.Errorf("only the large value should be streamed, got %s", &a.Stats.StreamsReceived)
+	}
+
+	var buf bytes.Buffer
+	if n, err := g.GetStream("large", &buf); err != nil || n != int64(len(large)) || buf.String() != large {
+		t.Errorf("group stream failed: %d bytes, %v", n, err)
+	}
+}
+
+// 对方给出的Content-Length不会直接用来分配
+func TestReadStreamLength(t *testing.T) {
+	res := &http.Response{ContentLength: 1 << 40, Body: io.NopCloser(strings.NewReader("630"))}
+	if value, err := readStream(res); err != nil || string(value) != "630" {
+		t.Fatalf("readStream returned %q, %v", value, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	doc := `{"rows":[` + strings.Repeat(`{"name":"Tom","score":630},`, 200) + `{}]}`
+	NewGroup("compress", 2<<20, GetterFunc(func(key string) ([]byte, error) {
+		if key == "small" {
+			return []byte("{}"), nil
+		}
+		return []byte(doc), nil
+	}))
+	a, addrA := newTestPool(t, nil)
+	b, addrB := newTestPool(t, nil)
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+
+	for _, key := range []string{"doc", "small"} {
+		res := &pb.Response{}
+		if err := a.httpGetters[addrB].Get(&pb.Request{Group: "compress", Key: key}, res); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]string{"doc": doc, "small": "{}"}[key]; string(res.Value) != want {
+			t.Fatalf("%s was not decompressed correctly", key)
+		}
+	}
+	if b.Stats.CompressedResponses.Get() != 1 {
+		t.Errorf("only the large value should be compressed, got %s", &b.Stats.CompressedResponses)
+	}
+	if b.Stats.CompressedBytes.Get()*5 > b.Stats.UncompressedBytes.Get() {
+		t.Errorf("json should compress at least 5x, got %s -> %s", &b.Stats.UncompressedBytes, &b.Stats.CompressedBytes)
+	}
+
+	// 只支持deflate的peer
+	req, _ := http.NewRequest(http.MethodGet, addrB+defaultBasePath+"compress/doc", nil)
+	req.Header.Set("Accept-Encoding", "deflate")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if enc := res.Header.Get("Content-Encoding"); enc != "deflate" {
+		t.Errorf("expected deflate, got %q", enc)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	NewGroup("errors", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(key, "missing"):
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		case key == "down":
+			return nil, fmt.Errorf("db: %w", ErrUnavailable)
+		}
+		return nil, errors.New("boom")
+	}))
+	a, addrA := newTestPool(t, nil)
+	b, addrB := newTestPool(t, nil)
+	a.SetPeers(addrA, addrB)
+	b.SetPeers(addrA, addrB)
+	getter := a.httpGetters[addrB]
+
+	cases := []struct {
+		group, key string
+		want       error
+	}{
+		{"errors", "missing", ErrNotFound},
+		{"errors", "down", ErrUnavailable},
+		{"no-such-group", "Tom", ErrGroupNotFound},
+	}
+	for _, c := range cases {
+		err := getter.Get(&pb.Request{Group: c.group, Key: c.key}, &pb.Response{})
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s/%s: want %v, got %v", c.group, c.key, c.want, err)
+		}
+	}
+	err := getter.Get(&pb.Request{Group: "errors", Key: "boom"}, &pb.Response{})
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnavailable) {
+		t.Errorf("untyped loader error should stay untyped, got %v", err)
+	}
+
+	// 数据源不可用不是节点故障
+	for i := 0; i < a.opts.FailureThreshold; i++ {
+		getter.Get(&pb.Request{Group: "errors", Key: "down"}, &pb.Response{})
+	}
+	if state := a.PeerHealth()[addrB]; state != BreakerClosed {
+		t.Errorf("unavailable data source should not open the breaker, got %s", state)
+	}
+
+	// 不认识状态码的客户端仍然可以按http状态码区分
+	res, err := http.Get(addrB + defaultBasePath + "errors/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing key should return 404, got %s", res.Status)
+	}
+
+}
@@ -171,6 +171,34 @@ func (c *Cache) RemoveHistoryCacheOldest() {
 	}
 }
 
+// 删除key 同时从缓存和历史队列中删除
+func (c *Cache) Remove(key string) {
+	if listEle, ok := c.cacheMap[key]; ok {
+		kv := listEle.Value.(*entry)
+		c.doublyll.Remove(listEle)
+		delete(c.cacheMap, key)
+		c.usedBytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	}
+	if listEle, ok := c.historyCache.cacheMap[key]; ok {
+		kv := listEle.Value.(*entry)
+		c.historyCache.doublyll.Remove(listEle)
+		c.historyCache.usedBytes -= int64(len(kv.key)) + int64(kv.value.Len())
+		delete(c.historyCache.cacheMap, key)
+		delete(c.historyCache.cnt, key)
+	}
+}
+
 func (c *Cache) GetCacheLen() int {
 	return c.doublyll.Len()
 }
+
+// 从最近使用到最久未使用遍历缓存（不包括历史队列），fn返回false时停止
+// 遍历不会改变元素的顺序
+func (c *Cache) Range(fn func(key string, value interface{ Len() int }) bool) {
+	for ele := c.doublyll.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		if !fn(kv.key, kv.value) {
+			return
+		}
+	}
+}
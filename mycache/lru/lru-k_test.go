@@ -56,3 +56,18 @@ func TestOnEvicted(t *testing.T) {
 	}
 
 }
+
+func TestRemove(t *testing.T) {
+	lru := New(int64(0), nil, 2)
+	lru.Add("key1", String("123"))
+	lru.Add("key1", String("123"))
+	lru.Add("key2", String("456"))
+	lru.Remove("key1")
+	lru.Remove("key2")
+	if _, ok := lru.Get("key1"); ok || lru.GetCacheLen() != 0 {
+		t.Fatalf("Remove key1 from cache failed")
+	}
+	if _, ok := lru.Get("key2"); ok {
+		t.Fatalf("Remove key2 from history failed")
+	}
+}
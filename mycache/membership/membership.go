@@ -0,0 +1,713 @@
+package membership
+
+// 基于SWIM协议的集群成员管理
+// SWIM (Scalable Weakly-consistent Infection-style Process Group Membership Protocol)
+// 1. 故障检测：每个周期探测一个成员(ping)，超时后请k个其他成员代为探测(ping-req)
+//    仍然没有回应就标记为suspect，suspect超时之后才确认dead，给网络抖动留出反驳的机会
+// 2. 信息传播：成员状态的变化附带在ping/ack消息中以gossip的方式传播，不需要额外的广播
+// 3. 反驳：节点听到关于自己的suspect消息时，增加incarnation并广播alive
+// 4. 反熵：附带的状态变化只发送有限次 定期与一个随机成员交换全部状态(push-pull) 保证视图最终一致
+// 成员视图变化时自动调用 HTTPPool.SetPeers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type State int
+
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+	StateLeft // 主动离开
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	case StateLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+type Member struct {
+	Name        string // 节点标识 即传给SetPeers的地址 例如 http://localhost:8001
+	Addr        string // gossip使用的UDP地址
+	State       State
+	Incarnation uint64 // 只有节点自己能增加 用来区分新旧消息
+}
+
+// 通常就是 *mycache.HTTPPool
+type PeerSetter interface {
+	SetPeers(peers ...string)
+}
+
+type Config struct {
+	Name     string // 节点标识
+	BindAddr string // 监听的UDP地址 端口为0时随机选择
+
+	// 故障检测参数
+	ProbeInterval    time.Duration // 探测周期 默认1s
+	ProbeTimeout     time.Duration // 等待直接ack的时间 默认300ms
+	IndirectChecks   int           // ping-req的成员数 默认3
+	SuspicionTimeout time.Duration // suspect确认为dead的时间 默认5s
+
+	// 每条状态变化附带发送的次数为 RetransmitMult*ceil(log10(n+1)) 默认4
+	RetransmitMult int
+
+	// 与随机成员交换全部状态的间隔 默认10s
+	PushPullInterval time.Duration
+
+	// 视图变化时调用 传入所有存活(alive和suspect)成员的Name
+	Peers PeerSetter
+}
+
+type Memberlist struct {
+	conf Config
+	conn *net.UDPConn
+
+	mu         sync.Mutex
+	self       Member
+	leaving    bool
+	members    map[string]*Member // 不包括自己
+	probeList  []string           // 打乱顺序的探测列表 轮流探测保证每个成员都会被检查到
+	probeIdx   int
+	broadcasts []*broadcast
+	suspicions map[string]*time.Timer
+
+	seq         atomic.Uint64
+	ackMu       sync.Mutex
+	ackHandlers map[uint64]func()
+
+	notifyMu  sync.Mutex // 保证SetPeers按顺序调用
+	lastPeers []string
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	wg           sync.WaitGroup
+}
+
+// 待传播的状态变化
+type broadcast struct {
+	u         update
+	transmits int
+}
+
+type msgType uint8
+
+const (
+	pingMsg msgType = iota
+	pingReqMsg
+	ackMsg
+	joinMsg
+	syncMsg // push-pull 附带发送方的全部状态 接收方回复自己的全部状态
+)
+
+type message struct {
+	Type       msgType  `json:"t"`
+	Seq        uint64   `json:"s"`
+	Target     string   `json:"ta,omitempty"` // ping-req: 被探测成员的UDP地址
+	TargetName string   `json:"tn,omitempty"` // ping/ping-req: 被探测成员的Name
+	Updates    []update `json:"u,omitempty"`  // 附带的状态变化
+	From       *update  `json:"f,omitempty"`  // 发送方自己的状态 接收方由此认识新成员
+}
+
+type update struct {
+	Name        string `json:"n"`
+	Addr        string `json:"a"`
+	State       State  `json:"s"`
+	Incarnation uint64 `json:"i"`
+}
+
+const (
+	maxPacketSize         = 65536
+	maxPiggyback          = 16 // 每条消息最多附带的状态变化数
+	defaultRetransmitMult = 4
+
+	defaultPushPullInterval = 10 * time.Second
+)
+
+// 创建并启动成员管理 之后调用Join加入集群
+func Create(conf *Config) (*Memberlist, error) {
+	if conf.Name == "" {
+		return nil, errors.New("membership: Name is required")
+	}
+	c := *conf
+	if c.ProbeInterval == 0 {
+		c.ProbeInterval = time.Second
+	}
+	if c.ProbeTimeout == 0 {
+		c.ProbeTimeout = 300 * time.Millisecond
+	}
+	if c.IndirectChecks == 0 {
+		c.IndirectChecks = 3
+	}
+	if c.SuspicionTimeout == 0 {
+		c.SuspicionTimeout = 5 * time.Second
+	}
+	if c.RetransmitMult == 0 {
+		c.RetransmitMult = defaultRetransmitMult
+	}
+	if c.PushPullInterval == 0 {
+		c.PushPullInterval = defaultPushPullInterval
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", c.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Memberlist{
+		conf:        c,
+		conn:        conn,
+		self:        Member{Name: c.Name, Addr: conn.LocalAddr().String(), State: StateAlive},
+		members:     make(map[string]*Member),
+		suspicions:  make(map[string]*time.Timer),
+		ackHandlers: make(map[uint64]func()),
+		shutdown:    make(chan struct{}),
+	}
+
+	m.wg.Add(3)
+	go m.readLoop()
+	go m.probeLoop()
+	go m.pushPullLoop()
+	m.notify()
+
+	return m, nil
+}
+
+// gossip实际监听的UDP地址
+func (m *Memberlist) Addr() string {
+	return m.self.Addr
+}
+
+// 通过种子节点加入集群 返回成功联系上的种子数
+// 种子节点会回复它知道的全部成员
+func (m *Memberlist) Join(seeds []string, timeout time.Duration) (int, error) {
+	seq := m.nextSeq()
+	acked := make(chan struct{}, len(seeds))
+	m.setAckHandler(seq, func() { acked <- struct{}{} }, timeout)
+
+	m.mu.Lock()
+	u := m.selfUpdate()
+	m.mu.Unlock()
+
+	sent := 0
+	for _, seed := range seeds {
+		if seed == m.self.Addr {
+			continue
+		}
+		m.send(seed, message{Type: joinMsg, Seq: seq, Updates: []update{u}})
+		sent++
+	}
+
+	n := 0
+	deadline := time.After(timeout)
+	for n < sent {
+		select {
+		case <-acked:
+			n++
+		case <-deadline:
+			if n == 0 {
+				return 0, errors.New("membership: no seed responded")
+			}
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// 当前知道的所有成员 包括自己
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := []Member{m.self}
+	for _, mem := range m.members {
+		members = append(members, *mem)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// 主动离开集群：通知其他成员自己已经离开 然后停止
+func (m *Memberlist) Leave(timeout time.Duration) error {
+	m.mu.Lock()
+	m.leaving = true
+	m.self.State = StateLeft
+	u := m.selfUpdate()
+	m.queueBroadcast(u)
+	var targets []string
+	for _, mem := range m.members {
+		if mem.State == StateAlive || mem.State == StateSuspect {
+			targets = append(targets, mem.Addr)
+		}
+	}
+	m.mu.Unlock()
+
+	m.notify()
+	// 不等下一轮探测 直接告诉所有成员
+	for _, addr := range targets {
+		m.send(addr, message{Type: pingMsg, Seq: m.nextSeq(), Updates: []update{u}})
+	}
+	select {
+	case <-time.After(timeout):
+	case <-m.shutdown:
+	}
+	return m.Shutdown()
+}
+
+// 停止gossip 不通知其他成员 它们会通过故障检测发现
+func (m *Memberlist) Shutdown() error {
+	var err error
+	m.shutdownOnce.Do(func() {
+		close(m.shutdown)
+		err = m.conn.Close()
+		m.wg.Wait()
+
+		m.mu.Lock()
+		for _, t := range m.suspicions {
+			t.Stop()
+		}
+		m.mu.Unlock()
+	})
+	return err
+}
+
+func (m *Memberlist) Log(format string, v ...any) {
+	log.Printf("[Gossip %s] "+format, append([]any{m.conf.Name}, v...)...)
+}
+
+// ----------------------网络收发---------------------------
+
+func (m *Memberlist) readLoop() {
+	defer m.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-m.shutdown:
+				return
+			default:
+				m.Log("read error: %v", err)
+				continue
+			}
+		}
+
+		var msg message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			m.Log("bad message from %s: %v", from, err)
+			continue
+		}
+		m.handle(&msg, from.String())
+	}
+}
+
+func (m *Memberlist) handle(msg *message, from string) {
+	// 不认识的成员发来的消息 说明它的加入消息还没有传播到这里
+	if msg.From != nil {
+		m.applyUpdate(*msg.From)
+	}
+	for _, u := range msg.Updates {
+		m.applyUpdate(u)
+	}
+	m.notify()
+
+	switch msg.Type {
+	case pingMsg:
+		// 地址可能已经被新的节点复用 只回复发给自己的ping
+		if msg.TargetName == "" || msg.TargetName == m.conf.Name {
+			m.send(from, message{Type: ackMsg, Seq: msg.Seq})
+		}
+	case pingReqMsg:
+		// 代替请求方探测目标 收到目标的ack后转发给请求方
+		seq := m.nextSeq()
+		m.setAckHandler(seq, func() {
+			m.send(from, message{Type: ackMsg, Seq: msg.Seq})
+		}, m.conf.ProbeInterval)
+		m.send(msg.Target, message{Type: pingMsg, Seq: seq, TargetName: msg.TargetName})
+	case ackMsg:
+		m.invokeAckHandler(msg.Seq)
+	case joinMsg, syncMsg:
+		// 回复全部成员 新节点不需要等待gossip慢慢传播
+		m.send(from, message{Type: ackMsg, Seq: msg.Seq, Updates: m.fullState()})
+	}
+}
+
+// 发送消息并附带待传播的状态变化
+func (m *Memberlist) send(addr string, msg message) {
+	msg.Updates = append(msg.Updates, m.getBroadcasts(maxPiggyback-len(msg.Updates))...)
+	m.mu.Lock()
+	self := m.selfUpdate()
+	m.mu.Unlock()
+	msg.From = &self
+
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		m.Log("encode error: %v", err)
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		m.Log("bad address %s: %v", addr, err)
+		return
+	}
+	if _, err := m.conn.WriteToUDP(data, udpAddr); err != nil {
+		select {
+		case <-m.shutdown:
+		default:
+			m.Log("send to %s failed: %v", addr, err)
+		}
+	}
+}
+
+func (m *Memberlist) nextSeq() uint64 {
+	return m.seq.Add(1)
+}
+
+// 注册收到ack时的回调 超时后自动删除
+func (m *Memberlist) setAckHandler(seq uint64, fn func(), timeout time.Duration) {
+	m.ackMu.Lock()
+	m.ackHandlers[seq] = fn
+	m.ackMu.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		m.ackMu.Lock()
+		delete(m.ackHandlers, seq)
+		m.ackMu.Unlock()
+	})
+}
+
+func (m *Memberlist) invokeAckHandler(seq uint64) {
+	m.ackMu.Lock()
+	fn, ok := m.ackHandlers[seq]
+	m.ackMu.Unlock()
+
+	if ok {
+		fn()
+	}
+}
+
+// ----------------------故障检测---------------------------
+
+func (m *Memberlist) probeLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.conf.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.probe()
+		case <-m.shutdown:
+			return
+		}
+	}
+}
+
+// 一轮探测：ping -> ping-req -> suspect
+func (m *Memberlist) probe() {
+	target, ok := m.nextProbeTarget()
+	if !ok {
+		return
+	}
+
+	seq := m.nextSeq()
+	acked := make(chan struct{}, m.conf.IndirectChecks+1)
+	m.setAckHandler(seq, func() {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	}, m.conf.ProbeInterval)
+
+	m.send(target.Addr, message{Type: pingMsg, Seq: seq, TargetName: target.Name})
+	select {
+	case <-acked:
+		return
+	case <-time.After(m.conf.ProbeTimeout):
+	case <-m.shutdown:
+		return
+	}
+
+	// 直接探测超时 可能只是两者之间的网络有问题 请其他成员帮忙
+	for _, helper := range m.randomMembers(m.conf.IndirectChecks, target.Name) {
+		m.send(helper.Addr, message{Type: pingReqMsg, Seq: seq, Target: target.Addr, TargetName: target.Name})
+	}
+	select {
+	case <-acked:
+		return
+	case <-time.After(m.conf.ProbeInterval - m.conf.ProbeTimeout):
+	case <-m.shutdown:
+		return
+	}
+
+	m.Log("%s did not respond, suspecting it", target.Name)
+	m.applyUpdate(update{Name: target.Name, Addr: target.Addr, State: StateSuspect, Incarnation: target.Incarnation})
+	m.notify()
+}
+
+func (m *Memberlist) nextProbeTarget() (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for checked := 0; checked <= len(m.probeList); checked++ {
+		if m.probeIdx >= len(m.probeList) {
+			// 一轮结束 重新打乱
+			m.probeList = m.probeList[:0]
+			for name, mem := range m.members {
+				if mem.State == StateAlive || mem.State == StateSuspect {
+					m.probeList = append(m.probeList, name)
+				}
+			}
+			rand.Shuffle(len(m.probeList), func(i, j int) {
+				m.probeList[i], m.probeList[j] = m.probeList[j], m.probeList[i]
+			})
+			m.probeIdx = 0
+			if len(m.probeList) == 0 {
+				return Member{}, false
+			}
+		}
+
+		mem := m.members[m.probeList[m.probeIdx]]
+		m.probeIdx++
+		if mem != nil && (mem.State == StateAlive || mem.State == StateSuspect) {
+			return *mem, true
+		}
+	}
+	return Member{}, false
+}
+
+// 定期与一个随机的存活成员交换全部状态
+// 附带的状态变化发送有限次之后就丢弃 没有收到的成员只能靠这里补上
+// 被误判为dead的节点也是通过这里看到关于自己的消息 然后反驳
+func (m *Memberlist) pushPullLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.conf.PushPullInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, mem := range m.randomMembers(1, "") {
+				m.send(mem.Addr, message{Type: syncMsg, Seq: m.nextSeq(), Updates: m.fullState()})
+			}
+		case <-m.shutdown:
+			return
+		}
+	}
+}
+
+// 随机选择k个存活成员 排除exclude
+func (m *Memberlist) randomMembers(k int, exclude string) []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var candidates []Member
+	for name, mem := range m.members {
+		if name != exclude && mem.State == StateAlive {
+			candidates = append(candidates, *mem)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+// ----------------------状态更新与传播---------------------------
+
+// 按SWIM的规则应用一条状态变化 新的状态会继续传播出去
+func (m *Memberlist) applyUpdate(u update) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u.Name == m.conf.Name {
+		// 有人认为自己挂了或者已经离开 增加incarnation反驳
+		// 离开之后用同一个名字重启的节点也要反驳 否则其他节点永远把它排除在外
+		if u.State != StateAlive && u.Incarnation >= m.self.Incarnation && !m.leaving {
+			m.self.Incarnation = u.Incarnation + 1
+			m.Log("refuting %s with incarnation %d", u.State, m.self.Incarnation)
+			m.queueBroadcast(m.selfUpdate())
+		}
+		return
+	}
+
+	cur, ok := m.members[u.Name]
+	if !ok {
+		m.members[u.Name] = &Member{Name: u.Name, Addr: u.Addr, State: u.State, Incarnation: u.Incarnation}
+		if u.State == StateAlive || u.State == StateSuspect {
+			m.Log("%s joined (%s)", u.Name, u.State)
+			m.queueBroadcast(u)
+		}
+		if u.State == StateSuspect {
+			m.startSuspicion(u.Name, u.Incarnation)
+		}
+		return
+	}
+
+	var apply bool
+	switch u.State {
+	case StateAlive:
+		apply = u.Incarnation > cur.Incarnation
+	case StateSuspect:
+		apply = (cur.State == StateAlive && u.Incarnation >= cur.Incarnation) ||
+			(cur.State == StateSuspect && u.Incarnation > cur.Incarnation)
+	case StateDead, StateLeft:
+		apply = (cur.State == StateAlive || cur.State == StateSuspect) && u.Incarnation >= cur.Incarnation
+	}
+	if !apply {
+		return
+	}
+
+	if cur.State != u.State {
+		m.Log("%s is now %s", u.Name, u.State)
+	}
+	cur.Addr, cur.State, cur.Incarnation = u.Addr, u.State, u.Incarnation
+	m.queueBroadcast(u)
+
+	if t, ok := m.suspicions[u.Name]; ok {
+		t.Stop()
+		delete(m.suspicions, u.Name)
+	}
+	if u.State == StateSuspect {
+		m.startSuspicion(u.Name, u.Incarnation)
+	}
+}
+
+// suspect超时且没有被反驳 确认为dead 调用时需持有m.mu
+func (m *Memberlist) startSuspicion(name string, incarnation uint64) {
+	m.suspicions[name] = time.AfterFunc(m.conf.SuspicionTimeout, func() {
+		m.mu.Lock()
+		mem, ok := m.members[name]
+		if !ok || mem.State != StateSuspect || mem.Incarnation != incarnation {
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+
+		m.applyUpdate(update{Name: name, Addr: mem.Addr, State: StateDead, Incarnation: incarnation})
+		m.notify()
+	})
+}
+
+// 调用时需持有m.mu
+func (m *Memberlist) selfUpdate() update {
+	return update{Name: m.self.Name, Addr: m.self.Addr, State: m.self.State, Incarnation: m.self.Incarnation}
+}
+
+// 同一个成员只保留最新的一条 调用时需持有m.mu
+func (m *Memberlist) queueBroadcast(u update) {
+	for i, b := range m.broadcasts {
+		if b.u.Name == u.Name {
+			m.broadcasts = append(m.broadcasts[:i], m.broadcasts[i+1:]...)
+			break
+		}
+	}
+	m.broadcasts = append(m.broadcasts, &broadcast{u: u})
+}
+
+// 取出发送次数最少的limit条状态变化 发送足够多次之后丢弃
+func (m *Memberlist) getBroadcasts(limit int) []update {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if limit <= 0 || len(m.broadcasts) == 0 {
+		return nil
+	}
+
+	maxTransmits := m.conf.RetransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+2))))
+	sort.SliceStable(m.broadcasts, func(i, j int) bool {
+		return m.broadcasts[i].transmits < m.broadcasts[j].transmits
+	})
+
+	var updates []update
+	kept := m.broadcasts[:0]
+	for i, b := range m.broadcasts {
+		if i < limit {
+			updates = append(updates, b.u)
+			b.transmits++
+		}
+		if b.transmits < maxTransmits {
+			kept = append(kept, b)
+		}
+	}
+	m.broadcasts = kept
+	return updates
+}
+
+func (m *Memberlist) fullState() []update {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := []update{m.selfUpdate()}
+	for _, mem := range m.members {
+		state = append(state, update{Name: mem.Name, Addr: mem.Addr, State: mem.State, Incarnation: mem.Incarnation})
+	}
+	return state
+}
+
+// 存活成员发生变化时调用SetPeers
+// suspect的成员仍然保留在视图中 避免一次网络抖动就触发数据迁移
+func (m *Memberlist) notify() {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	var peers []string
+	if !m.leaving {
+		peers = append(peers, m.conf.Name)
+	}
+	for name, mem := range m.members {
+		if mem.State == StateAlive || mem.State == StateSuspect {
+			peers = append(peers, name)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(peers)
+
+	if equalPeers(peers, m.lastPeers) {
+		return
+	}
+	m.lastPeers = peers
+	m.Log("peers changed: %v", peers)
+	if m.conf.Peers != nil {
+		m.conf.Peers.SetPeers(peers...)
+	}
+}
+
+func equalPeers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package membership
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录最近一次SetPeers的结果
+type recorder struct {
+	mu    sync.Mutex
+	peers []string
+}
+
+func (r *recorder) SetPeers(peers ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = peers
+}
+
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.peers)
+}
+
+func newTestNode(t *testing.T, i int) (*Memberlist, *recorder) {
+	r := &recorder{}
+	m, err := Create(&Config{
+		Name:             fmt.Sprintf("http://localhost:%d", 8001+i),
+		BindAddr:         "127.0.0.1:0",
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     20 * time.Millisecond,
+		SuspicionTimeout: 200 * time.Millisecond,
+		PushPullInterval: 100 * time.Millisecond,
+		Peers:            r,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Shutdown() })
+	return m, r
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 等待所有节点的视图收敛到n个成员 push-pull保证视图最终一致
+func waitConverged(t *testing.T, what string, recorders []*recorder, n int) {
+	waitFor(t, what, func() bool {
+		for _, r := range recorders {
+			if r.count() != n {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestJoinAndFailure(t *testing.T) {
+	seed, seedPeers := newTestNode(t, 0)
+	nodes := []*Memberlist{seed}
+	recorders := []*recorder{seedPeers}
+	for i := 1; i < 4; i++ {
+		m, r := newTestNode(t, i)
+		if _, err := m.Join([]string{seed.Addr()}, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, m)
+		recorders = append(recorders, r)
+	}
+
+	waitConverged(t, "all nodes to see 4 peers", recorders, 4)
+
+	// 直接停止 其他节点通过故障检测发现
+	nodes[3].Shutdown()
+	waitConverged(t, "all nodes to detect the failure", recorders[:3], 3)
+
+	// 主动离开 其他节点立即收到通知
+	if err := nodes[2].Leave(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, "all nodes to see the leave", recorders[:2], 2)
+	for _, mem := range seed.Members() {
+		if mem.Name == nodes[2].conf.Name && mem.State != StateLeft {
+			t.Errorf("%s should be left, got %s", mem.Name, mem.State)
+		}
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	a, _ := newTestNode(t, 0)
+	b, _ := newTestNode(t, 1)
+	if _, err := b.Join([]string{a.Addr()}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a 错误地怀疑 b，b 收到之后应当增加incarnation反驳
+	a.applyUpdate(update{Name: b.conf.Name, Addr: b.Addr(), State: StateSuspect, Incarnation: 0})
+	waitFor(t, "b to refute the suspicion", func() bool {
+		for _, mem := range a.Members() {
+			if mem.Name == b.conf.Name {
+				return mem.State == StateAlive && mem.Incarnation > 0
+			}
+		}
+		return false
+	})
+}
+
+func TestRefuteDeathWithPushPull(t *testing.T) {
+	a, _ := newTestNode(t, 0)
+	b, _ := newTestNode(t, 1)
+	if _, err := b.Join([]string{a.Addr()}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a 误判 b 已经dead 并且这条消息没有广播出去
+	// b 只能在push-pull中看到关于自己的消息 然后反驳
+	a.applyUpdate(update{Name: b.conf.Name, Addr: b.Addr(), State: StateDead, Incarnation: 0})
+	a.mu.Lock()
+	a.broadcasts = nil
+	a.mu.Unlock()
+	waitFor(t, "b to refute its death", func() bool {
+		for _, mem := range a.Members() {
+			if mem.Name == b.conf.Name {
+				return mem.State == StateAlive && mem.Incarnation > 0
+			}
+		}
+		return false
+	})
+}
+
+// 离开之后用同一个名字重启 其他节点重新接纳它
+func TestRejoinAfterLeave(t *testing.T) {
+	a, aPeers := newTestNode(t, 0)
+	b, _ := newTestNode(t, 1)
+	if _, err := b.Join([]string{a.Addr()}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to see b", func() bool { return aPeers.count() == 2 })
+
+	if err := b.Leave(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	b.Shutdown()
+	waitFor(t, "a to see the leave", func() bool { return aPeers.count() == 1 })
+
+	b2, b2Peers := newTestNode(t, 1)
+	if _, err := b2.Join([]string{a.Addr()}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, "both nodes to see 2 peers", []*recorder{aPeers, b2Peers}, 2)
+}
@@ -3,11 +3,14 @@ package mycache
 // 负责与外部交互，控制缓存存储和获取的主流程
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	pb "mycache/mycachepb"
 	"mycache/singleflight"
 	"sync"
+	"time"
 )
 
 // 首先定义一个接口 接口中具有一个Get方法
@@ -34,8 +37,32 @@ type Group struct {
 	mcache mainCache  // 并发LRU-K
 	peers  PeerPicker // 远程节点资源获取
 	loader *singleflight.Group
+	policy FailurePolicy // 从远程节点获取失败时的处理方式
+
+	// 处理peer请求时的本地加载 与loader分开
+	// 否则双方对key归属看法不同时 peer请求会等待本节点正在转发给对方的Load 两边互相等待
+	localLoader *singleflight.Group
+
+	streamMu sync.Mutex
+	streams  map[string]*streamCall // 正在从远程节点流式读取的key
+
+	Stats GroupStats
 }
 
+// 从远程节点获取失败时的处理方式
+type FailurePolicy int
+
+const (
+	// 在本地加载并缓存 默认行为 分区期间非owner也会缓存一份
+	LoadAndCache FailurePolicy = iota
+	// 直接返回错误
+	FailFast
+	// 向环上的下一个节点请求 下一个节点是自己时在本地加载并缓存
+	TryNext
+	// 在本地加载但不缓存 避免非owner保存重复的数据
+	LoadNoCache
+)
+
 var (
 	mu     sync.RWMutex
 	groups = make(map[string]*Group)
@@ -55,6 +82,7 @@ func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
 		mcache: mainCache{cacheBytes: cacheBytes},
 		loader: &singleflight.Group{},
 	}
+	g.localLoader = &singleflight.Group{}
 
 	groups[name] = g
 
@@ -81,6 +109,67 @@ func (g *Group) Get(key string) (ByteView, error) {
 	return g.Load(key)
 }
 
+// 写入key 发给key的owner 自己是owner时写入本地缓存
+func (g *Group) Set(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key is empty")
+	}
+	return g.write(&pb.WriteRequest{Group: g.name, Key: key, Value: cloneBytes(value)})
+}
+
+// 删除key 发给key的owner 自己是owner时从本地缓存删除
+func (g *Group) Remove(key string) error {
+	if key == "" {
+		return fmt.Errorf("key is empty")
+	}
+	return g.write(&pb.WriteRequest{Group: g.name, Key: key, Remove: true})
+}
+
+func (g *Group) write(req *pb.WriteRequest) error {
+	if g.peers != nil {
+		pick := g.peers.PickPeer
+		if op, ok := g.peers.(OwnerPicker); ok {
+			pick = op.PickOwner
+		}
+		if peer, ok := pick(req.Key); ok {
+			writer, ok := peer.(PeerWriter)
+			if !ok {
+				return fmt.Errorf("peer does not support writes")
+			}
+			return writer.Write(req)
+		}
+	}
+
+	g.applyWrite(req)
+	return nil
+}
+
+// 在本地缓存上执行写入或删除
+func (g *Group) applyWrite(req *pb.WriteRequest) {
+	if req.Remove {
+		g.mcache.remove(req.Key)
+		return
+	}
+	g.populateCache(req.Key, ByteView{bytes: req.Value})
+}
+
+// 所有已创建的group
+func allGroups() []*Group {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	gs := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		gs = append(gs, g)
+	}
+	return gs
+}
+
+// 设置从远程节点获取失败时的处理方式 需要在使用group之前设置
+func (g *Group) SetFailurePolicy(policy FailurePolicy) {
+	g.policy = policy
+}
+
 // 注入接口
 func (g *Group) RegisterPeers(peers PeerPicker) {
 	if g.peers != nil {
@@ -95,16 +184,29 @@ func (g *Group) Load(key string) (value ByteView, err error) {
 	viewi, err := g.loader.Do(key, func() (interface{}, error) {
 		if g.peers != nil {
 			// 首先选取哪一个远程节点
-			if peer, ok := g.peers.PickPeer(key); ok {
+			peer, ok, err := g.pickPeer(key)
+			if err != nil {
+				// owner不可用 没有发出请求 同样按policy处理
+				// 不记录日志 环版本不一致期间每个请求都会走到这里 原因已经由PeerPicker记录和统计
+				g.Stats.PeerErrors.Add(1)
+				return g.peerFailed(nil, key, err)
+			}
+			if ok {
 				// 从远程节点获取cache
 				if value, err = g.GetFromPeer(peer, key); err == nil {
 					return value, nil
 				}
+				// owner的数据源中没有这个key 不需要再按policy处理
+				if errors.Is(err, ErrNotFound) {
+					return nil, err
+				}
 				log.Println("[MyCache] Failed to get from peer", err)
+				g.Stats.PeerErrors.Add(1)
+				return g.peerFailed(peer, key, err)
 			}
 		}
 
-		return g.GetLocally(key)
+		return g.loadLocally(key)
 	})
 
 	if err == nil {
@@ -114,8 +216,77 @@ func (g *Group) Load(key string) (value ByteView, err error) {
 	return
 }
 
+// 选择key的远程节点 PeerPicker支持时区分owner不可用
+func (g *Group) pickPeer(key string) (PeerGetter, bool, error) {
+	if sp, ok := g.peers.(StrictPeerPicker); ok {
+		return sp.PickPeerStrict(key)
+	}
+	peer, ok := g.peers.PickPeer(key)
+	return peer, ok, nil
+}
+
+// 按policy处理远程节点获取失败 peer为nil表示owner不可用 没有发出请求
+func (g *Group) peerFailed(peer PeerGetter, key string, err error) (ByteView, error) {
+	switch g.policy {
+	case FailFast:
+		g.Stats.FailFast.Add(1)
+		return ByteView{}, err
+	case TryNext:
+		g.Stats.TryNext.Add(1)
+		if np, ok := g.peers.(NextPeerPicker); ok {
+			if next, ok := np.PickNextPeer(key, peer); ok {
+				value, err := g.GetFromPeer(next, key)
+				if err != nil {
+					g.Stats.TryNextErrors.Add(1)
+				}
+				return value, err
+			}
+		}
+		// 下一个节点就是自己
+		return g.loadLocally(key)
+	case LoadNoCache:
+		g.Stats.LoadNoCache.Add(1)
+		bytes, err := g.getter.Get(key)
+		if err != nil {
+			return ByteView{}, err
+		}
+		return ByteView{bytes: cloneBytes(bytes)}, nil
+	default:
+		g.Stats.LoadAndCache.Add(1)
+		return g.loadLocally(key)
+	}
+}
+
+// 只在本地获取 先查缓存再查数据源 不会再转发给其他节点
+// 用于处理其他节点转发过来的请求 即使双方对key的归属看法不同也不会来回转发
+func (g *Group) getFromLocal(key string) (ByteView, error) {
+	if key == "" {
+		return ByteView{}, fmt.Errorf("key is empty")
+	}
+
+	if cv, ok := g.mcache.Get(key); ok {
+		log.Println("[MyCache:] Hit Cache!")
+		return cv, nil
+	}
+
+	viewi, err := g.localLoader.Do(key, func() (interface{}, error) {
+		return g.loadLocally(key)
+	})
+	if err != nil {
+		return ByteView{}, err
+	}
+	return viewi.(ByteView), nil
+}
+
 // 从远程节点中获取cache
+// peers支持对冲时 primary超过观测到的p95还没有返回 就向另一个节点再发一个请求
 func (g *Group) GetFromPeer(peer PeerGetter, key string) (ByteView, error) {
+	if hp, ok := g.peers.(HedgePicker); ok {
+		if replica, delay, ok := hp.PickHedge(key, peer); ok {
+			return g.getHedged(hp, peer, replica, delay, key)
+		}
+	}
+
 	// protobuf的request
 	req := &pb.Request{
 		Group: g.name,
@@ -133,6 +304,88 @@ func (g *Group) GetFromPeer(peer PeerGetter, key string) (ByteView, error) {
 	return ByteView{bytes: res.Value}, nil
 }
 
+// 对冲请求 先成功返回的结果生效 返回之后取消另一个请求
+// replica是owner的后继 与普通请求一样可以从缓存或者数据源返回
+func (g *Group) getHedged(hp HedgePicker, primary, replica PeerGetter, delay time.Duration, key string) (ByteView, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		res   *pb.Response
+		err   error
+		hedge bool
+	}
+	results := make(chan result, 2) // 有缓冲 落后的一方返回时不会阻塞
+	fetch := func(ctx context.Context, peer PeerGetter, hedge bool) {
+		// 每个请求单独的Request 发送时会被填上环版本等字段
+		req, res := &pb.Request{Group: g.name, Key: key}, &pb.Response{}
+		var err error
+		if cp, ok := peer.(ContextPeerGetter); ok {
+			err = cp.GetContext(ctx, req, res)
+		} else {
+			err = peer.Get(req, res)
+		}
+		results <- result{res, err, hedge}
+	}
+
+	go fetch(ctx, primary, false)
+	pending := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		// primary在delay之内返回 失败时交给调用方处理 不再对冲
+		if r.err != nil {
+			return ByteView{}, r.err
+		}
+		return ByteView{bytes: r.res.Value}, nil
+	case <-timer.C:
+		if hp.AllowHedge() {
+			go fetch(ctx, replica, true)
+			pending++
+		}
+	}
+
+	// 都失败时返回primary的错误
+	var err error
+	for ; pending > 0; pending-- {
+		r := <-results
+		if r.err == nil {
+			return ByteView{bytes: r.res.Value}, nil
+		}
+		if !r.hedge {
+			err = r.err
+		}
+	}
+	return ByteView{}, err
+}
+
+// 回源之前 如果处于节点列表变化的过渡期 先向key的旧owner查询缓存
+func (g *Group) loadLocally(key string) (ByteView, error) {
+	if pp, ok := g.peers.(PreviousPeerPicker); ok {
+		if peer, ok := pp.PickPreviousPeer(key); ok {
+			req, res := &pb.Request{Group: g.name, Key: key, Peek: true}, &pb.Response{}
+			var err error
+			if cp, ok := peer.(ContextPeerGetter); ok {
+				ctx, cancel := context.WithTimeout(context.Background(), previousPeekTimeout)
+				err = cp.GetContext(ctx, req, res)
+				cancel()
+			} else {
+				err = peer.Get(req, res)
+			}
+			if err == nil {
+				cv := ByteView{bytes: res.Value}
+				g.populateCache(key, cv)
+				log.Println("[MyCache] Get from previous owner and populate!")
+				return cv, nil
+			}
+		}
+	}
+
+	return g.GetLocally(key)
+}
+
 // 本地获取节点 例如本地数据库
 func (g *Group) GetLocally(key string) (ByteView, error) {
 	bytes, err := g.getter.Get(key)
@@ -1,9 +1,17 @@
 package mycache
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	pb "mycache/mycachepb"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var db = map[string]string{
@@ -52,3 +60,340 @@ func TestGet(t *testing.T) {
 		t.Fatalf("[mycache_test:] The value of unknow should be empty, but %s got", view)
 	}
 }
+
+func TestSetRemove(t *testing.T) {
+	loads := 0
+	myCache := NewGroup("set-remove", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(db[key]), nil
+		}))
+
+	if err := myCache.Set("Tom", []byte("700")); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := myCache.Get("Tom"); err != nil || view.String() != "700" || loads != 0 {
+		t.Fatalf("[mycache_test:] Set value should be served from cache, got %s", view)
+	}
+
+	if err := myCache.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := myCache.Get("Tom"); err != nil || view.String() != "630" || loads != 1 {
+		t.Fatalf("[mycache_test:] Removed key should be loaded again, got %s", view)
+	}
+}
+
+type fakePeer struct {
+	err   error
+	value string
+	calls int
+}
+
+func (p *fakePeer) Get(in *pb.Request, out *pb.Response) error {
+	p.calls++
+	if p.err != nil {
+		return p.err
+	}
+	out.Value = []byte(p.value)
+	return nil
+}
+
+type fakePicker struct {
+	owner, next *fakePeer
+}
+
+func (p *fakePicker) PickPeer(key string) (PeerGetter, bool) {
+	return p.owner, true
+}
+
+func (p *fakePicker) PickNextPeer(key string, failed PeerGetter) (PeerGetter, bool) {
+	return p.next, p.next != nil
+}
+
+// 两个节点的HTTPPool key属于另一个节点 它的熔断器已经打开
+func newOpenOwnerPool(t *testing.T, key string) *HTTPPool {
+	peers := []string{"http://a", "http://b"}
+	probe := NewHTTPPool(peers[0])
+	probe.SetPeers(peers...)
+	owner, self := probe.chash.Get(key), peers[0]
+	if owner == self {
+		self = peers[1]
+	}
+
+	pool := newPool(t, self, &HTTPPoolOptions{BreakerOpenTimeout: time.Minute})
+	pool.SetPeers(peers...)
+	for i := 0; i < pool.opts.FailureThreshold; i++ {
+		pool.httpGetters[owner].breaker.failure()
+	}
+	return pool
+}
+
+func TestFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy FailurePolicy
+		next   *fakePeer
+		value  string // 空表示返回错误
+		loads  int
+		cached bool
+		stat   func(s *GroupStats) *AtomicInt
+		open   bool // owner熔断 请求没有发出
+	}{
+		{LoadAndCache, nil, "630", 1, true, func(s *GroupStats) *AtomicInt { return &s.LoadAndCache }, false},
+		{FailFast, nil, "", 0, false, func(s *GroupStats) *AtomicInt { return &s.FailFast }, false},
+		{TryNext, &fakePeer{value: "next"}, "next", 0, false, func(s *GroupStats) *AtomicInt { return &s.TryNext }, false},
+		{TryNext, nil, "630", 1, true, func(s *GroupStats) *AtomicInt { return &s.TryNext }, false},
+		{LoadNoCache, nil, "630", 1, false, func(s *GroupStats) *AtomicInt { return &s.LoadNoCache }, false},
+		{FailFast, nil, "", 0, false, func(s *GroupStats) *AtomicInt { return &s.FailFast }, true},
+		{LoadNoCache, nil, "630", 1, false, func(s *GroupStats) *AtomicInt { return &s.LoadNoCache }, true},
+		{TryNext, nil, "630", 1, true, func(s *GroupStats) *AtomicInt { return &s.TryNext }, true},
+	}
+
+	for i, tt := range tests {
+		loads := 0
+		g := NewGroup(fmt.Sprintf("policy-%d", i), 2<<10, GetterFunc(func(key string) ([]byte, error) {
+			loads++
+			return []byte(db[key]), nil
+		}))
+		g.SetFailurePolicy(tt.policy)
+		if tt.open {
+			g.RegisterPeers(newOpenOwnerPool(t, "Tom"))
+		} else {
+			g.RegisterPeers(&fakePicker{owner: &fakePeer{err: fmt.Errorf("down")}, next: tt.next})
+		}
+
+		view, err := g.Get("Tom")
+		if tt.value == "" && err == nil {
+			t.Errorf("case %d: expected an error, got %s", i, view)
+		}
+		if tt.value != "" && (err != nil || view.String() != tt.value) {
+			t.Errorf("case %d: expected %s, got %s %v", i, tt.value, view, err)
+		}
+		if loads != tt.loads {
+			t.Errorf("case %d: expected %d loads, got %d", i, tt.loads, loads)
+		}
+		if _, ok := g.mcache.Get("Tom"); ok != tt.cached {
+			t.Errorf("case %d: cached = %v, want %v", i, ok, tt.cached)
+		}
+		if g.Stats.PeerErrors.Get() != 1 || tt.stat(&g.Stats).Get() != 1 {
+			t.Errorf("case %d: policy should be counted once", i)
+		}
+	}
+}
+
+func TestCompressedStorage(t *testing.T) {
+	doc := strings.Repeat(`{"name":"Tom","score":630},`, 400) // 10KB
+	myCache := NewGroup("compressed-storage", 4<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(doc), nil
+		}))
+	myCache.SetCompression(1 << 10)
+
+	if _, err := myCache.GetLocally("doc"); err != nil {
+		t.Fatal(err)
+	}
+	// 原始大小超过cacheBytes 只有压缩之后才能放进缓存
+	if view, ok := myCache.mcache.Get("doc"); !ok || view.String() != doc {
+		t.Fatalf("[mycache_test:] compressed value should be cached and decompressed on read")
+	}
+
+	// 无法解压的值当作未命中并移除
+	myCache.mcache.mu.Lock()
+	myCache.mcache.lru.Add("broken", compressedView{data: []byte("not flate"), size: 100})
+	myCache.mcache.mu.Unlock()
+	if _, ok := myCache.mcache.Get("broken"); ok {
+		t.Fatal("corrupted value should be a miss")
+	}
+	myCache.mcache.mu.Lock()
+	_, ok := myCache.mcache.lru.Get("broken")
+	myCache.mcache.mu.Unlock()
+	if ok {
+		t.Error("corrupted value should be evicted")
+	}
+}
+
+func TestPeerNotFound(t *testing.T) {
+	loads := 0
+	g := NewGroup("peer-not-found", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}))
+	owner := &fakePeer{err: &peerError{status: pb.Status_NOT_FOUND, message: "Tom: not found"}}
+	g.RegisterPeers(&fakePicker{owner: owner})
+
+	// owner的数据源中没有这个key 不再按policy在本地加载
+	if _, err := g.Get("Tom"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get should return ErrNotFound, got %v", err)
+	}
+	if loads != 0 || g.Stats.PeerErrors.Get() != 0 {
+		t.Errorf("not found should not fall back, got %d loads and %s peer errors", loads, &g.Stats.PeerErrors)
+	}
+}
+
+// 阻塞到release关闭的PeerGetter
+type slowPeer struct {
+	calls   AtomicInt
+	release chan struct{}
+}
+
+func (p *slowPeer) Get(in *pb.Request, out *pb.Response) error {
+	p.calls.Add(1)
+	<-p.release
+	out.Value = []byte("630")
+	return nil
+}
+
+type slowPicker struct{ peer *slowPeer }
+
+func (p *slowPicker) PickPeer(key string) (PeerGetter, bool) {
+	return p.peer, true
+}
+
+// 并发的GetStream与Get一样只向远程节点请求一次
+func TestGetStreamDeduplicated(t *testing.T) {
+	g := NewGroup("stream-dedup", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, fmt.Errorf("should get from peer")
+	}))
+	peer := &slowPeer{release: make(chan struct{})}
+	g.RegisterPeers(&slowPicker{peer})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			if _, err := g.GetStream("Tom", &buf); err != nil || buf.String() != "630" {
+				errs <- fmt.Errorf("got %q, %v", buf.String(), err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(peer.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if peer.calls.Get() != 1 {
+		t.Errorf("concurrent streams should send 1 peer request, got %s", &peer.calls)
+	}
+}
+
+// 支持流式读取的peer 每次GetStream返回同一个pipe的读取端
+type pipePeer struct {
+	fakePeer
+	streams AtomicInt
+	r       *io.PipeReader
+}
+
+func (p *pipePeer) GetStream(ctx context.Context, in *pb.Request) (io.ReadCloser, error) {
+	p.streams.Add(1)
+	return p.r, nil
+}
+
+type pipePicker struct{ peer *pipePeer }
+
+func (p *pipePicker) PickPeer(key string) (PeerGetter, bool) {
+	return p.peer, true
+}
+
+// 通知收到了数据的Writer
+type notifyWriter struct {
+	bytes.Buffer
+	wrote chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	w.wrote <- struct{}{}
+	return n, err
+}
+
+// 远程节点的值边读边写 开始写出之前的并发请求共用同一个流
+func TestGetStreamFromPeer(t *testing.T) {
+	g := NewGroup("stream-peer", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, fmt.Errorf("should get from peer")
+	}))
+	r, pw := io.Pipe()
+	peer := &pipePeer{r: r}
+	g.RegisterPeers(&pipePicker{peer})
+
+	var wg sync.WaitGroup
+	dests := make([]*notifyWriter, 3)
+	for i := range dests {
+		dests[i] = &notifyWriter{wrote: make(chan struct{}, 2)}
+		wg.Add(1)
+		go func(w *notifyWriter) {
+			defer wg.Done()
+			if n, err := g.GetStream("Tom", w); err != nil || n != 6 {
+				t.Errorf("stream returned %d, %v", n, err)
+			}
+		}(dests[i])
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// 第二段数据在调用方收到第一段之后才写出 读完整个值再写会一直阻塞在这里
+	pw.Write([]byte("630"))
+	for _, w := range dests {
+		select {
+		case <-w.wrote:
+		case <-time.After(time.Second):
+			t.Fatal("first chunk should be written before the value is complete")
+		}
+	}
+	pw.Write([]byte("630"))
+	pw.Close()
+	wg.Wait()
+
+	for _, w := range dests {
+		if w.String() != "630630" {
+			t.Errorf("streamed %q", w.String())
+		}
+	}
+	if peer.streams.Get() != 1 {
+		t.Errorf("concurrent streams should share 1 peer stream, got %s", &peer.streams)
+	}
+}
+
+// 把请求转发回本节点的peer 模拟双方对key归属的看法不同
+type loopbackPeer struct{ g *Group }
+
+func (p *loopbackPeer) Get(in *pb.Request, out *pb.Response) error {
+	view, err := p.g.getFromLocal(in.Key)
+	if err != nil {
+		return err
+	}
+	out.Value = view.ByteSlice()
+	return nil
+}
+
+type loopbackPicker struct{ peer *loopbackPeer }
+
+func (p *loopbackPicker) PickPeer(key string) (PeerGetter, bool) {
+	return p.peer, true
+}
+
+// 被转发回来的请求在本地加载 不会等待正在转发它的Load
+func TestForwardedBackToSelf(t *testing.T) {
+	g := newTestGroup("loopback")
+	g.RegisterPeers(&loopbackPicker{&loopbackPeer{g}})
+
+	done := make(chan error, 1)
+	go func() {
+		view, err := g.Get("Tom")
+		if err == nil && view.String() != "630" {
+			err = fmt.Errorf("got %q", view.String())
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request forwarded back to the same node deadlocked")
+	}
+}
@@ -0,0 +1,214 @@
+// 手写的 service GroupCache 的服务端和客户端 对应 mycachepb.proto 中的定义
+// 新增rpc时需要同步修改这里
+//
+// 帧格式与gRPC相同 运行在HTTP/2上：
+//   请求 POST /mycachepb.GroupCache/<Method> content-type: application/grpc+proto
+//   消息 1字节压缩标志(总是0) + 4字节大端长度 + protobuf编码的消息
+//   状态 放在trailer的 Grpc-Status 和 Grpc-Message 中 出错时没有消息
+
+package mycachepb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	GroupCache_Get_FullMethodName = "/mycachepb.GroupCache/Get"
+
+	contentType = "application/grpc+proto"
+	// 单个消息的最大长度
+	maxMessageSize = 64 << 20
+)
+
+// RPC的状态码 取值与gRPC相同
+type Code uint32
+
+const (
+	OK              Code = 0
+	InvalidArgument Code = 3
+	NotFound        Code = 5
+	Unimplemented   Code = 12
+	Internal        Code = 13
+	Unavailable     Code = 14
+)
+
+// 带状态码的错误 服务端返回它时状态码原样传给客户端 其他错误为Internal
+type StatusError struct {
+	Code    Code
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", e.Code, e.Message)
+}
+
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &StatusError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// service GroupCache 的服务端
+type GroupCacheServer interface {
+	Get(ctx context.Context, in *Request) (*Response, error)
+}
+
+// service GroupCache 的客户端
+type GroupCacheClient interface {
+	Get(ctx context.Context, in *Request) (*Response, error)
+}
+
+// 把GroupCacheServer包装成http.Handler 需要运行在支持HTTP/2的server上
+func NewGroupCacheHandler(srv GroupCacheServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+
+		switch r.URL.Path {
+		case GroupCache_Get_FullMethodName:
+			in := &Request{}
+			if err := readMessage(r.Body, in); err != nil {
+				writeStatus(w, Errorf(InvalidArgument, "%v", err))
+				return
+			}
+			out, err := srv.Get(r.Context(), in)
+			if err != nil {
+				writeStatus(w, err)
+				return
+			}
+			if err := writeMessage(w, out); err != nil {
+				writeStatus(w, Errorf(Internal, "%v", err))
+				return
+			}
+			writeStatus(w, nil)
+		default:
+			writeStatus(w, Errorf(Unimplemented, "unknown method %s", r.URL.Path))
+		}
+	})
+}
+
+type groupCacheClient struct {
+	hc      *http.Client
+	baseURL string // 例如 http://localhost:8001
+}
+
+// hc需要支持HTTP/2 例如Transport.Protocols只开启了UnencryptedHTTP2
+func NewGroupCacheClient(hc *http.Client, baseURL string) GroupCacheClient {
+	return &groupCacheClient{hc: hc, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (c *groupCacheClient) Get(ctx context.Context, in *Request) (*Response, error) {
+	out := &Response{}
+	if err := c.invoke(ctx, GroupCache_Get_FullMethodName, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *groupCacheClient) invoke(ctx context.Context, method string, in, out proto.Message) error {
+	var body bytes.Buffer
+	if err := writeMessage(&body, in); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+method, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Te", "trailers")
+
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return Errorf(Unavailable, "%v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Errorf(Internal, "server returned: %v", res.Status)
+	}
+
+	msgErr := readMessage(res.Body, out)
+	// 读完body之后才能拿到trailer
+	io.Copy(io.Discard, res.Body)
+	if err := readStatus(res); err != nil {
+		return err
+	}
+	return msgErr
+}
+
+// 状态写在trailer中
+func writeStatus(w http.ResponseWriter, err error) {
+	code, msg := OK, ""
+	if err != nil {
+		code, msg = Internal, err.Error()
+		if se, ok := err.(*StatusError); ok {
+			code, msg = se.Code, se.Message
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(code)))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", msg)
+	}
+}
+
+// 没有消息的响应状态可能直接放在header中
+func readStatus(res *http.Response) error {
+	status, msg := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, msg = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return Errorf(Internal, "missing grpc-status")
+	}
+	if Code(code) != OK {
+		return &StatusError{Code: Code(code), Message: msg}
+	}
+	return nil
+}
+
+func writeMessage(w io.Writer, m proto.Message) error {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readMessage(r io.Reader, m proto.Message) error {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	if header[0] != 0 {
+		return fmt.Errorf("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxMessageSize {
+		return fmt.Errorf("message too large: %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, m)
+}
@@ -1,6 +1,11 @@
 package mycache
 
-import pb "mycache/mycachepb"
+import (
+	"context"
+	"io"
+	pb "mycache/mycachepb"
+	"time"
+)
 
 // 根据传入的key选择对应节点的PeerGetter方法
 type PeerPicker interface {
@@ -11,3 +16,51 @@ type PeerGetter interface {
 	// Get(group string, key string) ([]byte, error)
 	Get(in *pb.Request, out *pb.Response) error
 }
+
+// 支持写入和删除的节点 PickPeer返回的PeerGetter可以同时实现它
+type PeerWriter interface {
+	Write(in *pb.WriteRequest) error
+}
+
+// 能够区分"自己是owner"和"owner不可用"的PeerPicker
+// owner是其他节点但现在不可用时返回ok=false和错误 调用方按FailurePolicy处理 而不是当作自己是owner
+type StrictPeerPicker interface {
+	PickPeerStrict(key string) (peer PeerGetter, ok bool, err error)
+}
+
+// 返回key真正的owner 不因为熔断等原因改选其他节点 owner是自己时返回false
+// 写入必须发给owner owner不可用时由它暂存hint
+type OwnerPicker interface {
+	PickOwner(key string) (peer PeerGetter, ok bool)
+}
+
+// 节点列表变化的过渡期内 返回key在旧的环上的owner
+// 新owner未命中时先向旧owner查询缓存 避免扩缩容时请求全部落到数据源
+type PreviousPeerPicker interface {
+	PickPreviousPeer(key string) (peer PeerGetter, ok bool)
+}
+
+// 能够在节点失败之后选择环上下一个节点的PeerPicker
+// 下一个节点是自己时返回false failed为nil表示owner不可用 没有发出请求
+type NextPeerPicker interface {
+	PickNextPeer(key string, failed PeerGetter) (peer PeerGetter, ok bool)
+}
+
+// 支持流式读取的PeerGetter 较大的值不需要完整读入内存
+type PeerStreamer interface {
+	GetStream(ctx context.Context, in *pb.Request) (io.ReadCloser, error)
+}
+
+// 支持取消的PeerGetter 对冲请求中落后的一方会被取消
+type ContextPeerGetter interface {
+	GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error
+}
+
+// 支持对冲请求的PeerPicker
+// primary超过delay还没有返回时 向replica再发一个请求 先返回的结果生效
+type HedgePicker interface {
+	// key的另一个可以服务的节点 以及发出对冲请求之前等待的时间 不需要对冲时返回false
+	PickHedge(key string, primary PeerGetter) (replica PeerGetter, delay time.Duration, ok bool)
+	// 真正发出对冲请求之前调用 超出预算时返回false
+	AllowHedge() bool
+}
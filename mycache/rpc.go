@@ -0,0 +1,152 @@
+package mycache
+
+// 基于HTTP/2明文(h2c)的节点通信 实现mycachepb.proto中声明的 service GroupCache
+// 所有请求在每个peer的一条HTTP/2连接上多路复用
+// 帧格式见 mycachepb/mycachepb_rpc.go 与gRPC兼容
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mycache/consistenthash"
+	pb "mycache/mycachepb"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultRPCTimeout = 5 * time.Second
+
+type RPCPoolOptions struct {
+	// 虚拟节点倍数 默认50
+	Replicas int
+
+	// 放置算法 与HTTPPoolOptions.HashAlgorithm相同
+	HashAlgorithm string
+
+	// 单次请求的超时 默认5秒
+	Timeout time.Duration
+}
+
+// 实现PeerPicker 节点地址为 http://host:port
+type RPCPool struct {
+	self    string
+	opts    RPCPoolOptions
+	client  *http.Client // 只使用h2c
+	mu      sync.Mutex
+	chash   consistenthash.Placement
+	getters map[string]*rpcGetter
+}
+
+// 配置有误或者当前Go版本不支持h2c时返回错误
+func NewRPCPool(self string, o *RPCPoolOptions) (*RPCPool, error) {
+	p := &RPCPool{self: self}
+	if o != nil {
+		p.opts = *o
+	}
+	if p.opts.Replicas == 0 {
+		p.opts.Replicas = defaultReplicas
+	}
+	if p.opts.Timeout == 0 {
+		p.opts.Timeout = defaultRPCTimeout
+	}
+	if _, err := consistenthash.NewAlgorithm(p.opts.HashAlgorithm, p.opts.Replicas); err != nil {
+		return nil, err
+	}
+
+	transport, err := newH2CTransport()
+	if err != nil {
+		return nil, err
+	}
+	p.client = &http.Client{
+		Transport: transport,
+		Timeout:   p.opts.Timeout,
+	}
+	return p, nil
+}
+
+func (p *RPCPool) Log(format string, v ...interface{}) {
+	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+}
+
+func (p *RPCPool) SetPeers(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.chash, _ = consistenthash.NewAlgorithm(p.opts.HashAlgorithm, p.opts.Replicas)
+	p.chash.Add(peers...)
+	p.getters = make(map[string]*rpcGetter, len(peers))
+	for _, peer := range peers {
+		p.getters[peer] = &rpcGetter{client: pb.NewGroupCacheClient(p.client, peer)}
+	}
+}
+
+func (p *RPCPool) PickPeer(key string) (PeerGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.chash == nil {
+		return nil, false
+	}
+	if peer := p.chash.Get(key); peer != "" && peer != p.self {
+		p.Log("Pick Peer %s", peer)
+		return p.getters[peer], true
+	}
+	return nil, false
+}
+
+// 处理其他节点请求的handler 需要运行在开启了h2c的server上
+func (p *RPCPool) Handler() http.Handler {
+	return pb.NewGroupCacheHandler(rpcServer{})
+}
+
+// 监听addr(host:port) 同时接受HTTP/1.1和h2c
+func (p *RPCPool) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(l)
+}
+
+func (p *RPCPool) Serve(l net.Listener) error {
+	return newH2CServer(p.Handler()).Serve(l)
+}
+
+// 实现pb.GroupCacheServer 与HTTPPool一样 来自peer的请求只在本地处理
+type rpcServer struct{}
+
+func (rpcServer) Get(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	// 缓存本身的错误放在Response中 RPC的状态码只表示传输层的错误
+	group := GetGroup(in.Group)
+	if group == nil {
+		return errorResponse(fmt.Errorf("%w: %s", ErrGroupNotFound, in.Group)), nil
+	}
+	value, err := group.getFromLocal(in.Key)
+	if err != nil {
+		return errorResponse(err), nil
+	}
+	return &pb.Response{Value: value.ByteSlice()}, nil
+}
+
+// 实现PeerGetter和ContextPeerGetter
+type rpcGetter struct {
+	client pb.GroupCacheClient
+}
+
+func (g *rpcGetter) Get(in *pb.Request, out *pb.Response) error {
+	return g.GetContext(context.Background(), in, out)
+}
+
+func (g *rpcGetter) GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	res, err := g.client.Get(ctx, in)
+	if err != nil {
+		return err
+	}
+	if err := responseError(res); err != nil {
+		return err
+	}
+	out.Value = res.Value
+	return nil
+}
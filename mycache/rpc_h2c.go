@@ -0,0 +1,22 @@
+//go:build go1.24
+
+package mycache
+
+// http.Protocols从go1.24开始才有 h2c相关的代码单独放在这里
+// 模块本身仍然只要求go1.22 更早的版本上RPCPool不可用
+
+import "net/http"
+
+func newH2CTransport() (http.RoundTripper, error) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Transport{Protocols: &protocols}, nil
+}
+
+// 同时接受HTTP/1.1和h2c
+func newH2CServer(handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{Handler: handler, Protocols: &protocols}
+}
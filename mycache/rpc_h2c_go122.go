@@ -0,0 +1,19 @@
+//go:build !go1.24
+
+package mycache
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errH2CUnsupported = errors.New("mycache: h2c requires go1.24 or later")
+
+func newH2CTransport() (http.RoundTripper, error) {
+	return nil, errH2CUnsupported
+}
+
+// 创建RPCPool时已经失败 不会走到这里
+func newH2CServer(handler http.Handler) *http.Server {
+	return &http.Server{Handler: handler}
+}
@@ -0,0 +1,58 @@
+//go:build go1.24
+
+package mycache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	pb "mycache/mycachepb"
+)
+
+func TestRPCOverH2C(t *testing.T) {
+	newTestGroup("rpc")
+
+	pool, err := NewRPCPool("http://self", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h2 atomic.Int64
+	handler := pool.Handler()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			h2.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv.Config.Protocols = &protocols
+	srv.Start()
+	defer srv.Close()
+
+	pool.SetPeers("http://self", srv.URL)
+	getter := pool.getters[srv.URL]
+	for k, v := range db {
+		res := &pb.Response{}
+		if err := getter.Get(&pb.Request{Group: "rpc", Key: k}, res); err != nil || string(res.Value) != v {
+			t.Fatalf("rpc get %s failed: %v", k, err)
+		}
+	}
+	if h2.Load() != int64(len(db)) {
+		t.Errorf("all requests should use HTTP/2, got %d of %d", h2.Load(), len(db))
+	}
+
+	// 缓存的错误在Response中返回 不是RPC的错误
+	var se *pb.StatusError
+	err = getter.Get(&pb.Request{Group: "no-such-group", Key: "Tom"}, &pb.Response{})
+	if !errors.Is(err, ErrGroupNotFound) || errors.As(err, &se) {
+		t.Errorf("unknown group should return ErrGroupNotFound, got %v", err)
+	}
+	err = getter.Get(&pb.Request{Group: "rpc", Key: "unknown"}, &pb.Response{})
+	if err == nil || errors.Is(err, ErrNotFound) || errors.As(err, &se) {
+		t.Errorf("untyped loader error should stay untyped, got %v", err)
+	}
+}
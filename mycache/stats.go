@@ -0,0 +1,62 @@
+package mycache
+
+// 运行时的统计信息 全部使用原子操作 可以在任意goroutine中读取
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// 原子计数器
+type AtomicInt int64
+
+func (i *AtomicInt) Add(n int64) {
+	atomic.AddInt64((*int64)(i), n)
+}
+
+func (i *AtomicInt) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+func (i *AtomicInt) String() string {
+	return strconv.FormatInt(i.Get(), 10)
+}
+
+// HTTPPool的统计信息
+type PoolStats struct {
+	RingMismatches    AtomicInt // 与peer的环版本不一致的次数（收发两个方向）
+	RingRefusals      AtomicInt // 因为环版本不一致而拒绝的请求
+	AlgorithmRefusals AtomicInt // 因为放置算法不同而拒绝的请求
+	PeerRequests      AtomicInt // 收到的来自其他节点的请求
+	ForwardLoops      AtomicInt // 收到的请求按自己的环应当属于其他节点 本地处理而没有再次转发
+	HandoffSent       AtomicInt // 迁移给其他节点的条目
+	HandoffReceived   AtomicInt // 从其他节点迁移过来的条目
+	PreviousPeeks     AtomicInt // 过渡期内向旧owner查询缓存的次数
+	PreviousHits      AtomicInt // 其中旧owner命中的次数
+	HintsStored       AtomicInt // 替不可用的owner暂存的hint
+	HintsReplayed     AtomicInt // owner恢复之后重放成功的hint
+	HintsDropped      AtomicInt // 因为超出大小或过期而丢弃的hint
+	BreakerOpens      AtomicInt // 熔断器打开的次数
+	PeerReroutes      AtomicInt // owner熔断而改选其他节点的请求
+	Hedges            AtomicInt // 发出的对冲请求
+	HedgesOverBudget  AtomicInt // 超出预算而没有发出的对冲请求
+	StreamsSent       AtomicInt // 以原始数据返回的较大的值
+	StreamsReceived   AtomicInt // 通过GetStream流式读取的值
+
+	CompressedResponses AtomicInt // 压缩过的响应
+	UncompressedBytes   AtomicInt // 这些响应压缩前的大小
+	CompressedBytes     AtomicInt // 这些响应压缩后的大小
+
+	AuthRejected AtomicInt // 没有通过认证而拒绝的请求
+	CertReloads  AtomicInt // 证书文件变化之后重新加载的次数
+}
+
+// group的统计 主要是从远程节点获取失败之后各个policy的处理
+type GroupStats struct {
+	PeerErrors    AtomicInt // 从远程节点获取失败的次数
+	FailFast      AtomicInt // FailFast 直接返回错误
+	TryNext       AtomicInt // TryNext 改为请求下一个节点
+	TryNextErrors AtomicInt // 下一个节点同样失败
+	LoadNoCache   AtomicInt // LoadNoCache 本地加载不缓存
+	LoadAndCache  AtomicInt // LoadAndCache 本地加载并缓存
+}
@@ -0,0 +1,250 @@
+package mycache
+
+// 较大的值的流式传输
+// 普通的Get把整个值读入内存 再做protobuf解码 同一个值在内存中会有好几份
+// 超过 StreamThreshold 的值 服务端直接写出缓存中的原始数据 客户端不再做protobuf解码
+// Group.GetStream 在owner是支持 PeerStreamer 的远程节点时边读边写 每次最多占用streamBufSize
+// 开始写出之前到达的并发请求共用同一个远程请求 之后到达的重新发起
+// 打开流失败时按失败策略处理 与Load相同 流式读取不做对冲 读到的值也不缓存
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	pb "mycache/mycachepb"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultStreamThreshold = 1 << 20
+
+	// 流式读取时每次读取的大小
+	streamBufSize = 32 << 10
+
+	// 按Content-Length预先分配的上限 更大的响应随读取增长
+	maxStreamPrealloc = 4 << 20
+)
+
+// 把key的值写入w 出错时返回已经写出的字节数
+func (g *Group) GetStream(key string, w io.Writer) (int64, error) {
+	if key == "" {
+		return 0, fmt.Errorf("key is empty")
+	}
+	if cv, ok := g.mcache.Get(key); ok {
+		log.Println("[MyCache:] Hit Cache!")
+		return cv.WriteTo(w)
+	}
+
+	if g.peers != nil {
+		peer, ok, err := g.pickPeer(key)
+		if err != nil {
+			// owner不可用 与Load相同按policy处理
+			viewi, err := g.loader.Do(key, func() (interface{}, error) {
+				g.Stats.PeerErrors.Add(1)
+				return g.peerFailed(nil, key, err)
+			})
+			if err != nil {
+				return 0, err
+			}
+			return viewi.(ByteView).WriteTo(w)
+		}
+		if s, isStreamer := peer.(PeerStreamer); ok && isStreamer {
+			return g.streamFromPeer(peer, s, key, w)
+		}
+	}
+
+	// 自己是owner或者peer不支持流式读取
+	cv, err := g.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return cv.WriteTo(w)
+}
+
+// 同一个key正在进行的流式读取
+type streamCall struct {
+	mu      sync.Mutex
+	started bool // 已经写出了数据 之后的请求不能再加入
+	dests   []*streamDest
+	done    chan struct{}
+
+	// 没有写出任何数据就失败时 按policy得到的结果 所有请求共用
+	failed bool
+	view   ByteView
+	err    error
+}
+
+type streamDest struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+// 加入正在进行的读取 已经开始写出时返回false
+func (c *streamCall) join(d *streamDest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started {
+		return false
+	}
+	c.dests = append(c.dests, d)
+	return true
+}
+
+// 写给所有还没有出错的请求 全部出错时返回false
+func (c *streamCall) write(p []byte) bool {
+	c.mu.Lock()
+	c.started = true
+	c.mu.Unlock()
+
+	alive := false
+	for _, d := range c.dests {
+		if d.err != nil {
+			continue
+		}
+		n, err := d.w.Write(p)
+		d.n += int64(n)
+		d.err = err
+		alive = alive || err == nil
+	}
+	return alive
+}
+
+func (g *Group) streamFromPeer(peer PeerGetter, s PeerStreamer, key string, w io.Writer) (int64, error) {
+	d := &streamDest{w: w}
+
+	g.streamMu.Lock()
+	if c := g.streams[key]; c != nil && c.join(d) {
+		g.streamMu.Unlock()
+		<-c.done
+		return c.result(d)
+	}
+	c := &streamCall{dests: []*streamDest{d}, done: make(chan struct{})}
+	if g.streams == nil {
+		g.streams = make(map[string]*streamCall)
+	}
+	g.streams[key] = c
+	g.streamMu.Unlock()
+
+	g.runStream(c, peer, s, key)
+
+	g.streamMu.Lock()
+	if g.streams[key] == c {
+		delete(g.streams, key)
+	}
+	g.streamMu.Unlock()
+	close(c.done)
+	return c.result(d)
+}
+
+func (g *Group) runStream(c *streamCall, peer PeerGetter, s PeerStreamer, key string) {
+	rc, err := s.GetStream(context.Background(), &pb.Request{Group: g.name, Key: key})
+	if err == nil {
+		defer rc.Close()
+		buf := make([]byte, streamBufSize)
+		for {
+			var n int
+			n, err = rc.Read(buf)
+			if n > 0 && !c.write(buf[:n]) {
+				return // 所有请求都已经出错 例如客户端断开
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	c.mu.Lock()
+	started := c.started
+	c.mu.Unlock()
+	if started {
+		// 已经写出了一部分 只能返回错误
+		for _, d := range c.dests {
+			if d.err == nil {
+				d.err = err
+			}
+		}
+		return
+	}
+
+	// 还没有写出数据 与Load相同按policy处理
+	c.failed = true
+	if errors.Is(err, ErrNotFound) {
+		c.err = err
+		return
+	}
+	log.Println("[MyCache] Failed to stream from peer", err)
+	g.Stats.PeerErrors.Add(1)
+	c.view, c.err = g.peerFailed(peer, key, err)
+}
+
+func (c *streamCall) result(d *streamDest) (int64, error) {
+	if !c.failed {
+		return d.n, d.err
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.view.WriteTo(d.w)
+}
+
+// 返回值的Reader 较大的值直接读取响应 调用方负责关闭
+func (hg *httpGetter) GetStream(ctx context.Context, in *pb.Request) (io.ReadCloser, error) {
+	hg.inflight.Add(1)
+	defer hg.inflight.Add(-1)
+
+	res, err := hg.send(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if res.Header.Get(streamHeader) != "" {
+		hg.pool.Stats.StreamsReceived.Add(1)
+		return res.Body, nil
+	}
+
+	// 较小的值仍然是protobuf编码
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	out := &pb.Response{}
+	if err := proto.Unmarshal(body, out); err != nil {
+		return nil, fmt.Errorf("decoding response body: %v", err)
+	}
+	return io.NopCloser(bytes.NewReader(out.Value)), nil
+}
+
+// 直接写出原始数据
+func (hp *HTTPPool) serveStream(w http.ResponseWriter, r *http.Request, cv ByteView) {
+	hp.Stats.StreamsSent.Add(1)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(cv.Len()))
+	w.Header().Set(streamHeader, "1")
+	out, done := hp.compressWriter(w, r, cv.Len())
+	cv.WriteTo(out)
+	done()
+}
+
+// 读取原始数据 按Content-Length预先分配 最多maxStreamPrealloc 压缩过的响应长度未知
+// Content-Length来自对方 不能直接按它分配 读到的数据不足时由Transport报错
+func readStream(res *http.Response) ([]byte, error) {
+	var buf bytes.Buffer
+	if res.ContentLength > 0 {
+		buf.Grow(int(min(res.ContentLength, maxStreamPrealloc)))
+	}
+	if _, err := buf.ReadFrom(res.Body); err != nil {
+		return nil, fmt.Errorf("[ERROR] Reading response body: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,375 @@
+package mycache
+
+// 基于TCP的节点通信 与HTTPPool二选一
+// HTTP/1.1每个连接同一时间只能有一个请求 peer之间的流量大时成为瓶颈
+// 这里每一帧是4字节大端长度加上一个pb.Frame 请求带有id
+// 一个连接上可以同时有多个在途请求 响应可以乱序返回 按id交给等待的请求
+// 每个peer保持少量长连接 请求轮流使用
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mycache/consistenthash"
+	pb "mycache/mycachepb"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultTCPConnsPerPeer = 2
+	defaultTCPTimeout      = 5 * time.Second
+
+	// 一帧的最大长度 防止错误的长度导致分配过多内存
+	maxFrameSize = 64 << 20
+)
+
+var errConnClosed = errors.New("tcp connection closed")
+
+type TCPPoolOptions struct {
+	// 虚拟节点倍数 默认50
+	Replicas int
+
+	// 放置算法 与HTTPPoolOptions.HashAlgorithm相同
+	HashAlgorithm string
+
+	// 每个peer保持的连接数 默认2
+	ConnsPerPeer int
+
+	// 单次请求的超时 默认5秒
+	Timeout time.Duration
+}
+
+// 实现PeerPicker 节点地址为 host:port
+type TCPPool struct {
+	self    string
+	opts    TCPPoolOptions
+	mu      sync.Mutex
+	chash   consistenthash.Placement
+	getters map[string]*tcpGetter
+}
+
+// 配置有误时返回错误 例如不认识的放置算法
+func NewTCPPool(self string, o *TCPPoolOptions) (*TCPPool, error) {
+	p := &TCPPool{self: self}
+	if o != nil {
+		p.opts = *o
+	}
+	if p.opts.Replicas == 0 {
+		p.opts.Replicas = defaultReplicas
+	}
+	if p.opts.ConnsPerPeer == 0 {
+		p.opts.ConnsPerPeer = defaultTCPConnsPerPeer
+	}
+	if p.opts.Timeout == 0 {
+		p.opts.Timeout = defaultTCPTimeout
+	}
+	if _, err := consistenthash.NewAlgorithm(p.opts.HashAlgorithm, p.opts.Replicas); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *TCPPool) Log(format string, v ...interface{}) {
+	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+}
+
+// 更新节点列表 不再使用的连接会被关闭
+func (p *TCPPool) SetPeers(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.chash, _ = consistenthash.NewAlgorithm(p.opts.HashAlgorithm, p.opts.Replicas)
+	p.chash.Add(peers...)
+
+	getters := make(map[string]*tcpGetter, len(peers))
+	for _, peer := range peers {
+		if g, ok := p.getters[peer]; ok {
+			getters[peer] = g
+			delete(p.getters, peer)
+			continue
+		}
+		getters[peer] = &tcpGetter{
+			addr:    peer,
+			timeout: p.opts.Timeout,
+			conns:   make([]*tcpConn, p.opts.ConnsPerPeer),
+		}
+	}
+	for _, g := range p.getters {
+		g.close()
+	}
+	p.getters = getters
+}
+
+func (p *TCPPool) PickPeer(key string) (PeerGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.chash == nil {
+		return nil, false
+	}
+	if peer := p.chash.Get(key); peer != "" && peer != p.self {
+		p.Log("Pick Peer %s", peer)
+		return p.getters[peer], true
+	}
+	return nil, false
+}
+
+// 监听addr并处理其他节点的请求
+func (p *TCPPool) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(l)
+}
+
+func (p *TCPPool) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveConn(conn)
+	}
+}
+
+// 每个请求在单独的goroutine中处理 响应写回时加锁
+// 对方不读取时写入在Timeout之后失败并关闭连接 不会让其他响应一直等待锁
+func (p *TCPPool) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var wmu sync.Mutex
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				p.Log("Reading frame from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		go func() {
+			res := &pb.Frame{Id: frame.Id}
+			if value, err := p.handle(frame.Request); err != nil {
+				// Error给不认识状态码的旧版本
+				res.Error = err.Error()
+				res.Response = errorResponse(err)
+			} else {
+				res.Response = &pb.Response{Value: value.ByteSlice()}
+			}
+
+			wmu.Lock()
+			defer wmu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(p.opts.Timeout))
+			if err := writeFrame(conn, res); err != nil {
+				p.Log("Writing frame to %s: %v", conn.RemoteAddr(), err)
+				// 可能只写出了一部分 之后的帧无法再解析
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// 与HTTPPool一样 来自peer的请求只在本地处理
+func (p *TCPPool) handle(req *pb.Request) (ByteView, error) {
+	if req == nil {
+		return ByteView{}, fmt.Errorf("empty request")
+	}
+	group := GetGroup(req.Group)
+	if group == nil {
+		return ByteView{}, fmt.Errorf("%w: %s", ErrGroupNotFound, req.Group)
+	}
+	return group.getFromLocal(req.Key)
+}
+
+func readFrame(r io.Reader) (*pb.Frame, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	frame := &pb.Frame{}
+	if err := proto.Unmarshal(buf, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// 长度和内容一次写入 调用方负责加锁
+func writeFrame(w io.Writer, frame *pb.Frame) error {
+	body, err := proto.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+	_, err = w.Write(buf)
+	return err
+}
+
+// 对应一个peer 持有若干条连接
+type tcpGetter struct {
+	addr    string
+	timeout time.Duration
+	mu      sync.Mutex
+	conns   []*tcpConn // 延迟建立 断开之后下次使用时重连
+	next    int        // 轮流使用连接
+}
+
+func (g *tcpGetter) Get(in *pb.Request, out *pb.Response) error {
+	return g.GetContext(context.Background(), in, out)
+}
+
+func (g *tcpGetter) GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	conn, err := g.conn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	frame, err := conn.roundTrip(ctx, in)
+	if err != nil {
+		return err
+	}
+	if err := responseError(frame.Response); err != nil {
+		return err
+	}
+	if frame.Error != "" {
+		return fmt.Errorf("peer %s: %s", g.addr, frame.Error)
+	}
+	if frame.Response != nil {
+		out.Value = frame.Response.Value
+	}
+	return nil
+}
+
+// 轮流选择一条连接 没有建立或已经断开时重连
+func (g *tcpGetter) conn() (*tcpConn, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	i := g.next
+	g.next = (g.next + 1) % len(g.conns)
+	if c := g.conns[i]; c != nil && !c.closed.Load() {
+		return c, nil
+	}
+	nc, err := net.DialTimeout("tcp", g.addr, g.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := newTCPConn(nc)
+	g.conns[i] = c
+	return c, nil
+}
+
+func (g *tcpGetter) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, c := range g.conns {
+		if c != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+// 一条可以同时承载多个请求的连接
+type tcpConn struct {
+	conn    net.Conn
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	pending map[uint64]chan *pb.Frame // 等待响应的请求
+	nextID  atomic.Uint64
+	closed  atomic.Bool
+}
+
+func newTCPConn(conn net.Conn) *tcpConn {
+	c := &tcpConn{conn: conn, pending: make(map[uint64]chan *pb.Frame)}
+	go c.readLoop()
+	return c
+}
+
+// 读取响应 交给对应id的请求 连接断开时所有在途请求失败
+func (c *tcpConn) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			c.conn.Close()
+			c.mu.Lock()
+			c.closed.Store(true)
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[frame.Id]
+		delete(c.pending, frame.Id)
+		c.mu.Unlock()
+		if ok {
+			ch <- frame
+		}
+	}
+}
+
+func (c *tcpConn) roundTrip(ctx context.Context, in *pb.Request) (*pb.Frame, error) {
+	id := c.nextID.Add(1)
+	ch := make(chan *pb.Frame, 1)
+	c.mu.Lock()
+	if c.closed.Load() {
+		c.mu.Unlock()
+		return nil, errConnClosed
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	// 写入同样受ctx的超时限制 写入失败时可能只写出了一部分 关闭连接
+	c.wmu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	} else {
+		c.conn.SetWriteDeadline(time.Time{})
+	}
+	err := writeFrame(c.conn, &pb.Frame{Id: id, Request: in})
+	c.wmu.Unlock()
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case frame, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		return frame, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
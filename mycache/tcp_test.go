@@ -0,0 +1,153 @@
+package mycache
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "mycache/mycachepb"
+)
+
+// 启动一个TCPPool 返回pool和它的地址
+func newTestTCPPool(t testing.TB, opts *TCPPoolOptions) (*TCPPool, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	pool, err := NewTCPPool(l.Addr().String(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go pool.Serve(l)
+	return pool, l.Addr().String()
+}
+
+func TestTCPPipelining(t *testing.T) {
+	NewGroup("tcp", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		// 先到的请求后返回 响应在连接上乱序
+		if key == "slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return []byte("v-" + key), nil
+	}))
+	a, addrA := newTestTCPPool(t, &TCPPoolOptions{ConnsPerPeer: 1})
+	_, addrB := newTestTCPPool(t, nil)
+	a.SetPeers(addrA, addrB)
+	getter := a.getters[addrB]
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 51)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if i == 0 {
+			key = "slow"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &pb.Response{}
+			if err := getter.Get(&pb.Request{Group: "tcp", Key: key}, res); err != nil {
+				errs <- err
+			} else if string(res.Value) != "v-"+key {
+				errs <- fmt.Errorf("%s: got %s", key, res.Value)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if getter.conns[0] == nil || getter.conns[0].closed.Load() {
+		t.Error("all requests should share one open connection")
+	}
+
+	if err := getter.Get(&pb.Request{Group: "no-such-group", Key: "Tom"}, &pb.Response{}); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("unknown group should return ErrGroupNotFound, got %v", err)
+	}
+}
+
+// 对方不读取时写入超时 连接被关闭 之后的请求重新建立连接
+func TestTCPWriteTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	a, err := NewTCPPool("127.0.0.1:1", &TCPPoolOptions{ConnsPerPeer: 1, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetPeers(l.Addr().String())
+	getter := a.getters[l.Addr().String()]
+
+	// 足够大的请求填满发送缓冲区
+	key := string(make([]byte, 32<<20))
+	start := time.Now()
+	if err := getter.Get(&pb.Request{Group: "tcp", Key: key}, &pb.Response{}); err == nil {
+		t.Fatal("write to a peer that never reads should fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write should time out, took %v", elapsed)
+	}
+	waitFor(t, "the connection to close", getter.conns[0].closed.Load)
+}
+
+func TestTCPPoolUnknownAlgorithm(t *testing.T) {
+	if _, err := NewTCPPool("127.0.0.1:1", &TCPPoolOptions{HashAlgorithm: "nope"}); err == nil {
+		t.Fatal("unknown hash algorithm should be rejected")
+	}
+}
+
+func BenchmarkPeerGet(b *testing.B) {
+	NewGroup("bench", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("value"), nil
+	}))
+
+	tcpPool, tcpAddr := newTestTCPPool(b, nil)
+	tcpPool.SetPeers(tcpAddr)
+	httpPool, httpAddr := newTestPool(b, nil)
+	httpPool.SetPeers(httpAddr)
+
+	getters := map[string]PeerGetter{
+		"tcp":  tcpPool.getters[tcpAddr],
+		"http": httpPool.httpGetters[httpAddr],
+	}
+	// go1.24之前没有h2c 只比较另外两种
+	if rpcPool, err := NewRPCPool("http://self", nil); err == nil {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { l.Close() })
+		go rpcPool.Serve(l)
+		rpcAddr := "http://" + l.Addr().String()
+		rpcPool.SetPeers(rpcAddr)
+		getters["h2c"] = rpcPool.getters[rpcAddr]
+	}
+	for name, getter := range getters {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					if err := getter.Get(&pb.Request{Group: "bench", Key: "key"}, &pb.Response{}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
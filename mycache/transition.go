@@ -0,0 +1,68 @@
+package mycache
+
+// 成员变化时的双环过渡
+// SetPeers之后一部分key换了owner 新owner的缓存中还没有这些key
+// 过渡期内同时保留旧的环 新owner未命中时先向旧owner查询缓存 查不到才回源
+// 避免每次扩缩容时大量请求同时落到数据源
+
+import (
+	pb "mycache/mycachepb"
+	"net/http"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// 向旧owner查询的超时 旧owner可能已经宕机 查询失败时回源
+const previousPeekTimeout = 100 * time.Millisecond
+
+// 过渡期内key在旧的环上的owner 旧owner与新owner相同或是自己时不需要查询
+// 旧owner的熔断器打开时跳过 例如它已经宕机被移出节点列表
+func (hp *HTTPPool) PickPreviousPeer(key string) (PeerGetter, bool) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	if hp.prevChash == nil || hp.chash == nil {
+		return nil, false
+	}
+	if time.Now().After(hp.prevUntil) {
+		hp.prevChash, hp.prevGetters = nil, nil
+		return nil, false
+	}
+
+	prev := hp.prevChash.Get(key)
+	if prev == "" || prev == hp.self || prev == hp.chash.Get(key) {
+		return nil, false
+	}
+	getter, ok := hp.httpGetters[prev]
+	if !ok {
+		// 旧owner已经不在节点列表中 可能仍在下线迁移
+		getter, ok = hp.prevGetters[prev]
+	}
+	if !ok || !getter.breaker.allow() {
+		return nil, false
+	}
+	return getter, true
+}
+
+// 只返回本地缓存中的值 未命中时返回404
+func (hp *HTTPPool) servePeek(w http.ResponseWriter, groupName, key string) {
+	group := GetGroup(groupName)
+	if group == nil {
+		http.Error(w, "No such Group: "+groupName, http.StatusNotFound)
+		return
+	}
+	cv, ok := group.mcache.Get(key)
+	if !ok {
+		http.Error(w, "Not Cached", http.StatusNotFound)
+		return
+	}
+
+	body, err := proto.Marshal(&pb.Response{Value: cv.ByteSlice()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
@@ -0,0 +1,81 @@
+package mycache
+
+// Unix domain socket
+// 作为sidecar部署时 应用和mycache之间可以通过unix socket通信
+// peer地址可以是 http://host:port 也可以是 unix:///path/to/mycache.sock
+// http.Client只认识http(s)的URL 所以unix地址在请求时编码成一个特殊的host 拨号时再还原成socket路径
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	unixScheme  = "unix://"
+	httpScheme  = "http://"
+	httpsScheme = "https://"
+
+	// 编码后的host的后缀 前面是socket路径的hex
+	unixHostSuffix = ".sock.mycache"
+)
+
+// peer地址对应的http URL unix地址的路径编码到host中
+func peerURL(peer string) string {
+	if path, ok := strings.CutPrefix(peer, unixScheme); ok {
+		return httpScheme + hex.EncodeToString([]byte(path)) + unixHostSuffix
+	}
+	return peer
+}
+
+// 从拨号地址 host:port 中还原socket路径
+func unixSocketPath(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	encoded, ok := strings.CutSuffix(host, unixHostSuffix)
+	if !ok {
+		return "", false
+	}
+	path, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(path), true
+}
+
+// 包装DialContext unix地址改为拨号socket
+func unixAwareDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if path, ok := unixSocketPath(addr); ok {
+			return dial(ctx, "unix", path)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// unix地址不走代理
+func unixAwareProxy(req *http.Request) (*url.URL, error) {
+	if _, ok := unixSocketPath(req.URL.Host); ok {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// 按地址监听 支持 unix:///path、http(s)://host:port 和 host:port
+// unix socket文件已经存在时先删除 上次异常退出会留下它
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	addr = strings.TrimPrefix(addr, httpScheme)
+	return net.Listen("tcp", strings.TrimPrefix(addr, httpsScheme))
+}
@@ -0,0 +1,373 @@
+package mycache
+
+// 新节点加入集群时的预热
+// SetPeers之后一部分key的owner变成了新节点，如果新节点从空缓存开始，这些key会全部落到数据源
+// 新节点向之前环上的节点发送新的节点列表，对方按新的环找出属于新节点的条目分页返回
+// 拉取速度受 WarmupRate 限制，全部拉取完成之后才算就绪
+// 拉取失败的节点定期重试 直到成功或者它已经不在节点列表中
+// 按(group, key)排序之后用游标分页 LRU在分页期间的顺序变化不会导致遗漏或重复
+// 第一页时生成排好序的快照 之后的页在快照中按游标查找 不用每页重新收集和排序
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	pb "mycache/mycachepb"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	rangePath = "_range"
+
+	// 每页拉取的条目数
+	rangePageSize = 100
+
+	// 拉取失败之后重试的间隔
+	warmupRetryInterval = 5 * time.Second
+
+	// 快照在最后一次使用之后保留的时间 拉取方中途放弃时由它回收
+	rangeSnapshotTTL = time.Minute
+)
+
+type WarmupState string
+
+const (
+	WarmupIdle    WarmupState = "idle"
+	WarmupRunning WarmupState = "warming"
+	WarmupReady   WarmupState = "ready"
+	WarmupFailed  WarmupState = "failed" // 有节点拉取失败 正在等待重试
+)
+
+// 预热的进度
+type WarmupStatus struct {
+	State      WarmupState `json:"state"`
+	Sources    int         `json:"sources"` // 拉取数据的节点数
+	Entries    int64       `json:"entries"` // 已经拉取的条目数
+	Bytes      int64       `json:"bytes"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+	Errors     []string    `json:"errors,omitempty"`
+}
+
+func (hp *HTTPPool) WarmupStatus() WarmupStatus {
+	hp.warmMu.Lock()
+	defer hp.warmMu.Unlock()
+
+	status := hp.warm
+	if status.State == "" {
+		status.State = WarmupIdle
+	}
+	status.Errors = append([]string(nil), status.Errors...)
+	return status
+}
+
+// 是否可以对外提供服务 没有开启WarmJoin时总是就绪
+func (hp *HTTPPool) Ready() bool {
+	if !hp.opts.WarmJoin {
+		return true
+	}
+	return hp.WarmupStatus().State == WarmupReady
+}
+
+// 节点列表中除了自己还有其他节点 只有自己的环不算加入了集群
+func (hp *HTTPPool) joined(peers []string) bool {
+	return contains(peers, hp.self) && len(peers) > 1
+}
+
+// 只有自己时没有可以拉取的节点 直接就绪 之后真正加入集群时再预热
+// 调用时需持有hp.mu
+func (hp *HTTPPool) warmAlone() {
+	hp.warmMu.Lock()
+	defer hp.warmMu.Unlock()
+	if hp.warm.State == "" {
+		hp.warm = WarmupStatus{State: WarmupReady, StartedAt: time.Now(), FinishedAt: time.Now()}
+	}
+}
+
+// 开始预热 oldPeers是加入之前的节点列表 调用时需持有hp.mu
+func (hp *HTTPPool) startWarmup(oldPeers, peers []string, weights map[string]int) {
+	sources := without(oldPeers, hp.self)
+	// 启动时第一次SetPeers 或者之前只有自己 之前的节点就是除自己以外的节点
+	if len(sources) == 0 {
+		sources = without(peers, hp.self)
+	}
+
+	hp.warmMu.Lock()
+	defer hp.warmMu.Unlock()
+	if hp.warm.State == WarmupRunning || hp.warm.State == WarmupFailed {
+		return
+	}
+	hp.warm = WarmupStatus{State: WarmupRunning, Sources: len(sources), StartedAt: time.Now()}
+	if len(sources) == 0 {
+		// 集群中的第一个节点
+		hp.warm.State, hp.warm.FinishedAt = WarmupReady, time.Now()
+		return
+	}
+
+	req := &pb.RangeRequest{Requester: hp.self, Peers: peers}
+	if weights != nil {
+		for _, peer := range peers {
+			req.Weights = append(req.Weights, uint32(weights[peer]))
+		}
+	}
+	go hp.warmup(sources, req)
+}
+
+func without(peers []string, peer string) []string {
+	var rest []string
+	for _, p := range peers {
+		if p != peer {
+			rest = append(rest, p)
+		}
+	}
+	return rest
+}
+
+func (hp *HTTPPool) warmup(sources []string, req *pb.RangeRequest) {
+	hp.Log("Warming up from %v", sources)
+	start := time.Now()
+	var pulled int64
+
+	for {
+		var failed []string
+		for _, source := range sources {
+			if err := hp.pullFrom(source, req, &pulled, start); err != nil {
+				hp.Log("Warm up from %s failed: %v", source, err)
+				hp.updateWarmup(func(s *WarmupStatus) { s.Errors = append(s.Errors, fmt.Sprintf("%s: %v", source, err)) })
+				failed = append(failed, source)
+			}
+		}
+
+		// 已经离开集群的节点不再重试
+		hp.mu.Lock()
+		sources = sources[:0]
+		for _, source := range failed {
+			if contains(hp.peers, source) {
+				sources = append(sources, source)
+			}
+		}
+		hp.mu.Unlock()
+		if len(sources) == 0 {
+			break
+		}
+
+		hp.updateWarmup(func(s *WarmupStatus) { s.State = WarmupFailed })
+		hp.Log("Warm up from %v failed, retrying in %v", sources, warmupRetryInterval)
+		time.Sleep(warmupRetryInterval)
+	}
+
+	hp.updateWarmup(func(s *WarmupStatus) {
+		s.State, s.FinishedAt = WarmupReady, time.Now()
+	})
+	status := hp.WarmupStatus()
+	hp.Log("Warm up finished: %d entries, %d bytes in %v", status.Entries, status.Bytes, time.Since(start))
+}
+
+// 从一个节点分页拉取属于自己的条目 重试时从头开始 已经拉取的条目会被覆盖
+func (hp *HTTPPool) pullFrom(source string, req *pb.RangeRequest, pulled *int64, start time.Time) error {
+	getter := hp.newGetter(source)
+	page := proto.Clone(req).(*pb.RangeRequest)
+	page.Limit = rangePageSize
+
+	for {
+		res, err := getter.getRange(page)
+		if err != nil {
+			return err
+		}
+
+		var n int64
+		for _, e := range res.Entries {
+			if g := GetGroup(e.Group); g != nil {
+				g.populateCache(e.Key, ByteView{bytes: e.Value})
+			}
+			n += int64(len(e.Key) + len(e.Value))
+		}
+		*pulled += n
+		hp.updateWarmup(func(s *WarmupStatus) {
+			s.Entries += int64(len(res.Entries))
+			s.Bytes += n
+		})
+
+		if !res.More || len(res.Entries) == 0 {
+			return nil
+		}
+		last := res.Entries[len(res.Entries)-1]
+		page.AfterGroup, page.AfterKey = last.Group, last.Key
+		hp.throttle(*pulled, time.Since(start))
+	}
+}
+
+// 按WarmupRate限速 已经拉取了n字节 用时elapsed
+func (hp *HTTPPool) throttle(n int64, elapsed time.Duration) {
+	if hp.opts.WarmupRate <= 0 {
+		return
+	}
+	want := time.Duration(float64(n) / float64(hp.opts.WarmupRate) * float64(time.Second))
+	if want > elapsed {
+		time.Sleep(want - elapsed)
+	}
+}
+
+func (hp *HTTPPool) updateWarmup(fn func(s *WarmupStatus)) {
+	hp.warmMu.Lock()
+	defer hp.warmMu.Unlock()
+	fn(&hp.warm)
+}
+
+// 按请求中的新节点列表 返回本地缓存中属于请求方的条目
+func (hp *HTTPPool) serveRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &pb.RangeRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var weights map[string]int
+	if len(req.Weights) == len(req.Peers) && len(req.Weights) > 0 {
+		weights = make(map[string]int, len(req.Peers))
+		for i, peer := range req.Peers {
+			weights[peer] = int(req.Weights[i])
+		}
+	}
+	snap := hp.rangeSnapshot(req, weights)
+
+	// 从游标之后开始
+	matched := snap.entries
+	if req.AfterGroup != "" {
+		matched = matched[sort.Search(len(matched), func(i int) bool {
+			e := matched[i]
+			return e.Group > req.AfterGroup || e.Group == req.AfterGroup && e.Key > req.AfterKey
+		}):]
+	}
+
+	res := &pb.RangeResponse{Entries: matched}
+	if req.Limit > 0 && len(matched) > int(req.Limit) {
+		res.Entries, res.More = matched[:req.Limit], true
+	} else {
+		hp.dropRangeSnapshot(req.Requester, snap) // 最后一页
+	}
+
+	data, err := proto.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// 一个requester正在拉取的条目 按(group, key)排序
+type rangeSnapshot struct {
+	ring    string // 请求中的节点列表和权重 变化之后重新生成
+	entries []*pb.Entry
+	used    time.Time
+}
+
+type rangeSnapshots struct {
+	mu    sync.Mutex
+	snaps map[string]*rangeSnapshot // key是requester
+}
+
+// 第一页总是重新生成快照 之后的页复用 快照过期或者节点列表变化时按游标从新的快照继续
+func (hp *HTTPPool) rangeSnapshot(req *pb.RangeRequest, weights map[string]int) *rangeSnapshot {
+	ring := fmt.Sprint(req.Peers, req.Weights)
+	now := time.Now()
+
+	rs := &hp.ranges
+	rs.mu.Lock()
+	for requester, s := range rs.snaps {
+		if now.Sub(s.used) > rangeSnapshotTTL {
+			delete(rs.snaps, requester)
+		}
+	}
+	if s := rs.snaps[req.Requester]; s != nil && s.ring == ring && req.AfterGroup != "" {
+		s.used = now
+		rs.mu.Unlock()
+		return s
+	}
+	rs.mu.Unlock()
+
+	// 收集条目时不持有锁
+	placement := hp.newPlacement(req.Peers, weights)
+	var entries []*pb.Entry
+	for _, g := range allGroups() {
+		keys, values := g.mcache.entries()
+		for i, key := range keys {
+			if placement.Get(key) == req.Requester {
+				entries = append(entries, &pb.Entry{Group: g.name, Key: key, Value: values[i].bytes})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Group != entries[j].Group {
+			return entries[i].Group < entries[j].Group
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	s := &rangeSnapshot{ring: ring, entries: entries, used: now}
+	rs.mu.Lock()
+	if rs.snaps == nil {
+		rs.snaps = make(map[string]*rangeSnapshot)
+	}
+	rs.snaps[req.Requester] = s
+	rs.mu.Unlock()
+	return s
+}
+
+func (hp *HTTPPool) dropRangeSnapshot(requester string, s *rangeSnapshot) {
+	hp.ranges.mu.Lock()
+	defer hp.ranges.mu.Unlock()
+	if hp.ranges.snaps[requester] == s {
+		delete(hp.ranges.snaps, requester)
+	}
+}
+
+// GET <basePath>_admin/ready
+func (hp *HTTPPool) serveReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !hp.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(hp.WarmupStatus())
+}
+
+// 拉取一页属于自己的条目
+func (hg *httpGetter) getRange(req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := hg.post(rangePath, body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned: %v", res.Status)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	out := &pb.RangeResponse{}
+	if err := proto.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+// ring 子命令：扩缩容之前评估哈希环的变化
+// ./server ring -current a,b,c -proposed a,b,c,d -keys keys.txt
+// keys.txt 每行一个key，可以直接用访问日志中的key，重复出现的key按访问次数计算
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"mycache/consistenthash"
+	"os"
+	"sort"
+	"strings"
+)
+
+func ringCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("ring", flag.ContinueOnError)
+	current := fs.String("current", "", "Current peers, comma separated")
+	proposed := fs.String("proposed", "", "Proposed peers, comma separated")
+	keysFile := fs.String("keys", "", "File with one sampled key per line")
+	placement := fs.String("placement", "ring", "Placement strategy: ring, rendezvous, jump or maglev")
+	hash := fs.String("hash", "crc32", "Hash algorithm of the ring: crc32, fnv1a64 or crc64")
+	replicas := fs.Int("replicas", 50, "Virtual nodes per peer")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	before, after := splitPeers(*current), splitPeers(*proposed)
+	if len(before) == 0 || len(after) == 0 || *keysFile == "" {
+		return fmt.Errorf("ring: -current, -proposed and -keys are required")
+	}
+	keys, err := readKeys(*keysFile)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("ring: no keys in %s", *keysFile)
+	}
+
+	oldRing, err := newPlacement(*placement, *hash, *replicas)
+	if err != nil {
+		return err
+	}
+	newRing, _ := newPlacement(*placement, *hash, *replicas)
+	oldRing.Add(before...)
+	newRing.Add(after...)
+
+	// 迁移的key在新的owner上是冷的 每个key只有变化之后的第一次访问落到数据源 之后就命中了
+	moved := consistenthash.Moved(oldRing, newRing, keys)
+	coldMisses := consistenthash.ColdMisses(oldRing, newRing, keys)
+	cold := 0
+	for _, n := range coldMisses {
+		cold += n
+	}
+
+	fmt.Fprintf(out, "keys sampled: %d (%d distinct)\n", len(keys), distinct(keys))
+	fmt.Fprintf(out, "keys moved:   %d (%.2f%% of requests)\n", moved, percent(moved, len(keys)))
+	fmt.Fprintf(out, "cold misses:  %d (%.2f%% of requests go to the source while the moved keys are refilled)\n\n", cold, percent(cold, len(keys)))
+
+	oldOwners := consistenthash.Ownership(oldRing, keys)
+	newOwners := consistenthash.Ownership(newRing, keys)
+	fmt.Fprintf(out, "%-32s %16s %16s %16s\n", "peer", "current", "proposed", "cold misses")
+	for _, peer := range unionPeers(before, after) {
+		fmt.Fprintf(out, "%-32s %8d %6.2f%% %8d %6.2f%% %8d %6.2f%%\n", peer,
+			oldOwners[peer], percent(oldOwners[peer], len(keys)),
+			newOwners[peer], percent(newOwners[peer], len(keys)),
+			coldMisses[peer], percent(coldMisses[peer], len(keys)))
+	}
+
+	oldMax, oldStddev := consistenthash.Balance(oldOwners, before)
+	newMax, newStddev := consistenthash.Balance(newOwners, after)
+	fmt.Fprintf(out, "\nbalance current:  max/mean=%.3f stddev/mean=%.3f\n", oldMax, oldStddev)
+	fmt.Fprintf(out, "balance proposed: max/mean=%.3f stddev/mean=%.3f\n", newMax, newStddev)
+
+	return nil
+}
+
+func newPlacement(name, hash string, replicas int) (consistenthash.Placement, error) {
+	switch name {
+	case "ring":
+		return consistenthash.NewAlgorithm(hash, replicas)
+	case "rendezvous":
+		return consistenthash.NewRendezvous(nil), nil
+	case "jump":
+		return consistenthash.NewJump(nil), nil
+	case "maglev":
+		return consistenthash.NewMaglev(0, nil), nil
+	}
+	return nil, fmt.Errorf("ring: unknown placement %q", name)
+}
+
+func splitPeers(s string) []string {
+	var peers []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func unionPeers(a, b []string) []string {
+	seen := make(map[string]bool)
+	var peers []string
+	for _, p := range append(append([]string{}, a...), b...) {
+		if !seen[p] {
+			seen[p] = true
+			peers = append(peers, p)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func readKeys(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+func distinct(keys []string) int {
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+	return len(seen)
+}
+
+func percent(n, total int) float64 {
+	return 100 * float64(n) / float64(total)
+}